@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Rules for automatically picking one audio stream when a file has several.
+type AudioSelection struct {
+	Rules     []string // Applied in order, each narrowing down the candidates: "language", "default", "channels".
+	Languages []string // For the 'language' rule, most preferred first, eg ["eng", "jpn"].
+	Exclude   []string // Streams whose title contains any of these are never picked, eg ["commentary"].
+}
+
+const (
+	audioRuleLanguage = "language" // Prefer the earliest language in AudioSelection.Languages.
+	audioRuleDefault  = "default"  // Prefer streams flagged with the default disposition.
+	audioRuleChannels = "channels" // Prefer the most channels.
+)
+
+func isValidAudioRule(rule string) bool {
+	return rule == audioRuleLanguage || rule == audioRuleDefault || rule == audioRuleChannels
+}
+
+// Picks the audio stream according to the configured rules, logging the reasoning as it goes.
+// Returns nil if the rules can't decide, eg there are no rules, or several streams are still tied at the end.
+func selectAudioStream(streams []ProbeStream, selection AudioSelection) *ProbeStream {
+	if len(selection.Rules) == 0 && len(selection.Exclude) == 0 {
+		return nil
+	}
+
+	// Remove the ones we never want.
+	candidates := make([]ProbeStream, 0)
+	for _, stream := range streams {
+		if word := excludedWordForAudioStream(stream, selection.Exclude); word != "" {
+			log.Printf("Audio selection: excluding %s as it matches '%s'", describeAudioStream(stream), word)
+		} else {
+			candidates = append(candidates, stream)
+		}
+	}
+
+	// Narrow it down, rule by rule.
+	for _, rule := range selection.Rules {
+		if len(candidates) <= 1 {
+			break
+		}
+		narrowed := make([]ProbeStream, 0)
+		switch rule {
+		case audioRuleLanguage:
+			narrowed = audioStreamsWithPreferredLanguage(candidates, selection.Languages)
+		case audioRuleDefault:
+			for _, stream := range candidates {
+				if stream.Disposition.Default == 1 {
+					narrowed = append(narrowed, stream)
+				}
+			}
+		case audioRuleChannels:
+			mostChannels := 0
+			for _, stream := range candidates {
+				if stream.Channels > mostChannels {
+					mostChannels = stream.Channels
+				}
+			}
+			for _, stream := range candidates {
+				if stream.Channels == mostChannels {
+					narrowed = append(narrowed, stream)
+				}
+			}
+		}
+		if len(narrowed) == 0 {
+			log.Printf("Audio selection: rule '%s' matched none of the candidates, ignoring it", rule)
+			continue
+		}
+		log.Printf("Audio selection: rule '%s' narrowed %d candidates down to %s", rule, len(candidates), describeAudioStreams(narrowed))
+		candidates = narrowed
+	}
+
+	if len(candidates) == 1 {
+		log.Printf("Audio selection: picked %s", describeAudioStream(candidates[0]))
+		return &candidates[0]
+	}
+	if len(candidates) == 0 {
+		log.Println("Audio selection: every stream was excluded, the rules can't decide")
+	} else {
+		log.Printf("Audio selection: still tied between %s, the rules can't decide", describeAudioStreams(candidates))
+	}
+	return nil
+}
+
+// The streams in the most preferred language that any candidate has.
+func audioStreamsWithPreferredLanguage(candidates []ProbeStream, languages []string) []ProbeStream {
+	for _, preferred := range languages {
+		matches := make([]ProbeStream, 0)
+		for _, stream := range candidates {
+			if isSameLanguage(stream.Tags.Language, preferred) {
+				matches = append(matches, stream)
+			}
+		}
+		if len(matches) > 0 {
+			return matches
+		}
+	}
+	return nil
+}
+
+// Returns which of the excluded words the stream's title contains, or "" if none.
+// Streams with the 'comment' disposition are treated as if their title said 'commentary'.
+func excludedWordForAudioStream(stream ProbeStream, exclude []string) string {
+	title := strings.ToLower(stream.Tags.Title)
+	if stream.Disposition.Comment == 1 {
+		title += " commentary"
+	}
+	for _, word := range exclude {
+		if word != "" && strings.Contains(title, strings.ToLower(word)) {
+			return word
+		}
+	}
+	return ""
+}
+
+// Eg 'stream 2 (eng, ac3, 6 channels, 448kbps, "Commentary")'.
+func describeAudioStream(stream ProbeStream) string {
+	language := stream.Tags.Language
+	if language == "" {
+		language = "und"
+	}
+	description := fmt.Sprintf("stream %d (%s, %s, %d channels", stream.Index, language, stream.Codec_name, stream.Channels)
+	if bitRate := stream.bitRate(); bitRate > 0 {
+		description += fmt.Sprintf(", %dkbps", bitRate/1000)
+	}
+	if stream.Tags.Title != "" {
+		description += fmt.Sprintf(", %q", stream.Tags.Title)
+	}
+	if stream.Disposition.Default == 1 {
+		description += ", default"
+	}
+	return description + ")"
+}
+
+func describeAudioStreams(streams []ProbeStream) string {
+	descriptions := make([]string, 0)
+	for _, stream := range streams {
+		descriptions = append(descriptions, describeAudioStream(stream))
+	}
+	return strings.Join(descriptions, ", ")
+}
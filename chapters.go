@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// A chapter, as stored in the metadata.
+type Chapter struct {
+	Title string
+	Start float64 // Seconds from the start of the HLS output.
+	End   float64
+}
+
+// Gets the chapters from a probe. Their times are made relative to the start of the file, as ffmpeg does to the output.
+func chaptersFrom(result *ProbeResult) []Chapter {
+	offset := result.Format.startSeconds()
+	chapters := make([]Chapter, 0)
+	for i, probeChapter := range result.Chapters {
+		start, end, ok := probeChapter.times()
+		if !ok {
+			continue
+		}
+		title := probeChapter.Tags.Title
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		chapters = append(chapters, Chapter{
+			Title: title,
+			Start: math.Max(0, start-offset),
+			End:   math.Max(0, end-offset),
+		})
+	}
+	return chapters
+}
+
+// Writes the chapters as a WebVTT chapters track, for a player's <track kind="chapters">.
+func writeChaptersVTT(outFolder string, chapters []Chapter) error {
+	content := "WEBVTT\n"
+	for i, chapter := range chapters {
+		content += fmt.Sprintf("\n%d\n%s --> %s\n%s\n", i+1, formatVTTTimestamp(chapter.Start), formatVTTTimestamp(chapter.End), chapter.Title)
+	}
+	return os.WriteFile(filepath.Join(outFolder, chaptersFilename), []byte(content), os.ModePerm)
+}
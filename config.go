@@ -8,9 +8,32 @@ import (
 	"strings"
 )
 
+const (
+	hlsSegmentTypeMPEGTS = "mpegts" // The default.
+	hlsSegmentTypeFMP4   = "fmp4"   // Fragmented MP4 aka CMAF, which allows HEVC.
+)
+
 type Config struct {
-	Root         string
-	DebugSkipHLS bool // Skip conversion, this is good for speeding up dev/debugging.
+	Root                 string
+	DebugSkipHLS         bool                       // Skip conversion, this is good for speeding up dev/debugging.
+	AudioSelection       AudioSelection             // How to pick an audio stream when there's more than one.
+	HLSSegmentType       string                     // "mpegts" or "fmp4", blank means mpegts.
+	HEVCPassthrough      bool                       // When making fmp4, copy HEVC video rather than converting it to h264. Only newer players support this.
+	Encoder              EncoderSettings            // How to encode video when it needs transcoding.
+	EncoderPresets       map[string]EncoderSettings // Named tweaks to Encoder, chosen with eg 'preset-cartoon' in the filename.
+	LoudnessTarget       float64                    // Normalise audio to this many LUFS, eg -16. 0 means don't normalise.
+	Downmix              map[string]string          // Pan filters for downmixing to stereo, keyed by channel layout, overriding the built-in ones.
+	SkipTrickplay        bool                       // Don't make scrubbing preview thumbnails, which takes a while on slow machines.
+	TrickplayInterval    int                        // Seconds between scrubbing preview thumbnails, 0 means every 10s.
+	SkipMarkers          bool                       // Don't look for TV episodes' intros and credits.
+	KeepSurround         bool                       // Keep surround audio as a second rendition, as well as the stereo downmix.
+	WorkerListen         string                     // Address to hand transcode jobs to 'gondola worker' processes on, eg "0.0.0.0:8077". Just a port, eg ":8077", means loopback only. Blank means no workers.
+	WorkerToken          string                     // Shared secret that workers have to send, needed if WorkerListen is set.
+	WorkerLeaseSeconds   int                        // How long a worker can go quiet before its job is done locally, 0 means 60.
+	WorkerWaitSeconds    int                        // How long a job waits for a worker before it's done locally, 0 means 30.
+	VerifySampleDecode   bool                       // Decode a few segments when checking the output, rather than just checking they're there.
+	SkipEstimate         bool                       // Don't benchmark a sample to estimate how long transcodes will take.
+	EstimateCeilingHours float64                    // Transcodes estimated to take longer than this are held for the user to confirm, 0 means no limit.
 }
 
 func loadConfig() (Config, error) {
@@ -33,6 +56,35 @@ func loadConfig() (Config, error) {
 		return Config{}, errors.New("'root' is missing from your config file. It should point to a root folder where your media is to be stored.")
 	}
 
+	if conf.HLSSegmentType != "" && conf.HLSSegmentType != hlsSegmentTypeMPEGTS && conf.HLSSegmentType != hlsSegmentTypeFMP4 {
+		return Config{}, errors.New("'hlsSegmentType' in your config file should be 'mpegts' or 'fmp4'.")
+	}
+	if conf.HEVCPassthrough && conf.HLSSegmentType != hlsSegmentTypeFMP4 {
+		return Config{}, errors.New("'hevcPassthrough' in your config file needs 'hlsSegmentType = \"fmp4\"', as HEVC isn't allowed in MPEG-TS segments.")
+	}
+
+	if conf.LoudnessTarget != 0 && (conf.LoudnessTarget > -5 || conf.LoudnessTarget < -70) {
+		return Config{}, errors.New("'loudnessTarget' in your config file should be in LUFS, between -70 and -5, eg -16.")
+	}
+
+	if conf.TrickplayInterval < 0 {
+		return Config{}, errors.New("'trickplayInterval' in your config file should be the number of seconds between thumbnails, eg 10.")
+	}
+
+	if conf.EstimateCeilingHours < 0 {
+		return Config{}, errors.New("'estimateCeilingHours' in your config file should be the number of hours a transcode can take without asking, eg 12.")
+	}
+
+	if conf.WorkerListen != "" && len(conf.WorkerToken) < workerMinTokenLength {
+		return Config{}, errors.New("'workerToken' in your config file should be a secret of at least 16 characters, as anyone with it can read and write your library, eg from 'openssl rand -hex 16'.")
+	}
+
+	for _, rule := range conf.AudioSelection.Rules {
+		if !isValidAudioRule(rule) {
+			return Config{}, errors.New("Unknown audio selection rule '" + rule + "' in your config file. Valid rules are 'language', 'default' and 'channels'.")
+		}
+	}
+
 	return conf, nil
 }
 
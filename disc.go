@@ -0,0 +1,462 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	isoSectorSize    = 2048
+	discSettleTime   = 60 * time.Second // A VIDEO_TS folder's files must be untouched for this long before it's processed, as folders are copied a file at a time.
+	discConcatFormat = "dvd"            // Keeps it as a VOB, so it goes through the pipeline like any other.
+	discMarkerSuffix = ".extracted"     // Eg '.VIDEO_TS.extracted' next to the disc, recording the VOB it was extracted as, and how that went.
+)
+
+// How the VOB extracted from a disc went, as recorded in the marker.
+const (
+	discResultPending = ""       // Not processed yet, eg it's been renamed for the user to choose its audio stream.
+	discResultDone    = "done"   // Processed, and removed from New.
+	discResultFailed  = "failed" // Moved to Failed.
+)
+
+var (
+	discVOBRegex         = regexp.MustCompile(`(?i)^VTS_(\d\d)_([1-9])\.VOB$`) // _0 is the menu, so it's left out.
+	discTitleRegex       = regexp.MustCompile(`(?i)DVDTitle(\d+)`)
+	discGenericNameRegex = regexp.MustCompile(`(?i)^(VIDEO_TS|DVD|DVD_VIDEO|DISC|DISK|CDROM)?[ _.-]*\d*$`)
+	discNumberRegex      = regexp.MustCompile(`(?i)(^|[ _.-]+)(DISC|DISK|D)[ _.-]*\d+$`) // Eg '_DISC_1' or ' D2', but not the 'D1' of 'DVD1'.
+)
+
+// Written next to a disc once its main title has been extracted, so the disc can be dealt with once the VOB has been.
+type discMarker struct {
+	VOB    string // Eg 'Big Buck Bunny.vob'.
+	Result string // One of the discResult constants.
+}
+
+// One VOB of a title set, as something ffmpeg can open: a path, or a 'subfile' URL of part of an ISO.
+type discVOB struct {
+	Name   string // Eg 'VTS_01_1.VOB'.
+	URL    string
+	Offset int64 // In the ISO, or 0 in a folder.
+	Size   int64
+}
+
+// The bits of a DVD we care about.
+type disc struct {
+	Label     string            // The volume label, eg 'BIG_BUCK_BUNNY', or "" for a folder.
+	TitleSets map[int][]discVOB // Keyed by title set number, eg 1 for VTS_01_*.
+}
+
+// Whether a folder in New is a DVD: either a VIDEO_TS folder, or one with a VIDEO_TS folder in it.
+func isVideoTSFolder(path string) bool {
+	return videoTSFolderIn(path) != ""
+}
+
+func videoTSFolderIn(path string) string {
+	if strings.EqualFold(filepath.Base(path), "VIDEO_TS") {
+		return path
+	}
+	files, _ := ioutil.ReadDir(path)
+	for _, file := range files {
+		if file.IsDir() && strings.EqualFold(file.Name(), "VIDEO_TS") {
+			return filepath.Join(path, file.Name())
+		}
+	}
+	return ""
+}
+
+// Turns a dropped VIDEO_TS folder or ISO into a single VOB in the same folder, then processes that as usual.
+// The main title is the longest title set, or the one asked for with eg 'DVDTitle2' in the name.
+// The disc is kept until the VOB has been processed, as it has the other title sets and extras, and is moved to Failed if the VOB fails.
+func tryProcessDisc(folder string, name string, isMovies bool, paths Paths, config Config) {
+	discPath := filepath.Join(folder, name)
+	isISO := strings.EqualFold(filepath.Ext(name), ".iso")
+	markerPath := filepath.Join(folder, "."+name+discMarkerSuffix)
+
+	// Already extracted, eg the VOB was renamed for the user to choose its audio stream.
+	if marker, err := readDiscMarker(markerPath); err == nil {
+		finishDisc(folder, name, marker, paths)
+		return
+	}
+
+	// Wait until it's all copied.
+	if isISO {
+		if !canGetExclusiveAccessToFile(discPath) {
+			log.Println("Couldn't get exclusive access to", name, "might be still copying")
+			return
+		}
+	} else if !isDiscFolderSettled(discPath) {
+		log.Println("DVD folder", name, "has been changed recently, might be still copying, will check again later")
+		requestRescanAfter(discSettleTime)
+		return
+	}
+
+	var d *disc
+	var err error
+	if isISO {
+		d, err = readISODisc(discPath)
+	} else {
+		d, err = readFolderDisc(videoTSFolderIn(discPath))
+	}
+	if err == nil && len(d.TitleSets) == 0 {
+		err = errors.New("No title sets found")
+	}
+	if err != nil {
+		log.Println("Couldn't read the DVD", name, "-", err)
+		moveToFailed(discPath, paths)
+		writeFailedReason(discPath, paths, err.Error())
+		return
+	}
+	if d.Label != "" {
+		log.Println("DVD volume label:", d.Label)
+	}
+
+	titleSet, err := discTitleSetFor(d, name)
+	if err != nil {
+		log.Println(err)
+		moveToFailed(discPath, paths)
+		writeFailedReason(discPath, paths, err.Error())
+		return
+	}
+	vobs := d.TitleSets[titleSet]
+
+	// Concatenate it into a hidden file first, so it's not picked up half-made.
+	outName := discOutputName(name, d.Label, isISO) + ".vob"
+	outPath := filepath.Join(folder, outName)
+	if exists(outPath) {
+		log.Println("Not extracting the DVD", name, "as", outName, "already exists")
+		return
+	}
+	tempPath := filepath.Join(folder, "."+outName)
+	log.Printf("Extracting title set %d of the DVD %s (%d VOBs) as %s", titleSet, name, len(vobs), outName)
+	args := []string{
+		"-fflags", "+genpts",
+		"-analyzeduration", "100M", "-probesize", "100M", // DVD subtitles often don't start for a while, so look further for them.
+		"-i", discConcatURL(vobs),
+		"-map", "0:v", "-map", "0:a?", "-map", "0:s?",
+		"-c", "copy",
+		"-f", discConcatFormat,
+		"-y", tempPath,
+	}
+	if _, err := ffmpeg(args); err != nil {
+		os.Remove(tempPath)
+		log.Println("Couldn't extract the DVD", name, "-", err)
+		moveToFailed(discPath, paths)
+		writeFailedReason(discPath, paths, "Couldn't extract the main title: "+err.Error())
+		return
+	}
+	if err := writeDiscMarker(markerPath, discMarker{VOB: outName}); err != nil {
+		os.Remove(tempPath)
+		log.Println("Couldn't record that the DVD was extracted:", err)
+		return
+	}
+	if err := os.Rename(tempPath, outPath); err != nil {
+		log.Println("Couldn't rename the extracted DVD:", err)
+		return
+	}
+	log.Println("Extracted the DVD", name, "as", outName)
+	tryProcess(folder, outName, isMovies, paths, config)
+	if marker, err := readDiscMarker(markerPath); err == nil {
+		finishDisc(folder, name, marker, paths)
+	}
+}
+
+// Once the VOB extracted from a disc has been dealt with, the disc goes the same way: removed if the VOB succeeded, or to Failed if not, as recorded in the marker.
+// While the VOB (or a renamed version of it, eg with 'AudioStreamX') is still in New, the disc is kept.
+func finishDisc(folder string, name string, marker discMarker, paths Paths) {
+	discPath := filepath.Join(folder, name)
+	markerPath := filepath.Join(folder, "."+name+discMarkerSuffix)
+	switch marker.Result {
+	case discResultDone:
+		log.Println("Processed", marker.VOB, "so removing the DVD", name)
+		os.RemoveAll(discPath)
+	case discResultFailed:
+		log.Println("Processing", marker.VOB, "failed, so moving the DVD", name, "to the Failed folder too")
+		moveToFailed(discPath, paths)
+		writeFailedReason(discPath, paths, "Its main title was extracted as "+marker.VOB+", which failed, see its reason file")
+	default:
+		if hasFileStartingWith(folder, discVOBBase(marker.VOB)) {
+			log.Println("Keeping the DVD", name, "until", marker.VOB, "has been processed")
+			return
+		}
+		log.Println(marker.VOB, "has gone from New without being processed, so moving the DVD", name, "to the Failed folder")
+		moveToFailed(discPath, paths)
+		writeFailedReason(discPath, paths, "Its main title was extracted as "+marker.VOB+", which was removed before it was processed")
+	}
+	os.Remove(markerPath)
+}
+
+// What the extracted VOB's name starts with, even once it's been renamed, eg 'Movie.' for 'Movie.AudioStreamX.vob.please insert...'.
+func discVOBBase(vob string) string {
+	return strings.TrimSuffix(vob, filepath.Ext(vob)) + "."
+}
+
+func readDiscMarker(path string) (discMarker, error) {
+	var marker discMarker
+	err := readAndUnmarshal(filepath.Dir(path), filepath.Base(path), &marker)
+	return marker, err
+}
+
+func writeDiscMarker(path string, marker discMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, os.ModePerm)
+}
+
+// Records how a source went in the marker of the disc it was extracted from, if it was, so the disc can follow it.
+// Called as the source is removed or moved to Failed.
+func recordDiscResult(inPath string, result string) {
+	folder := filepath.Dir(inPath)
+	files, _ := ioutil.ReadDir(folder)
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") || !strings.HasSuffix(file.Name(), discMarkerSuffix) {
+			continue
+		}
+		markerPath := filepath.Join(folder, file.Name())
+		marker, err := readDiscMarker(markerPath)
+		if err != nil || marker.Result != discResultPending || !strings.HasPrefix(filepath.Base(inPath), discVOBBase(marker.VOB)) {
+			continue
+		}
+		marker.Result = result
+		if err := writeDiscMarker(markerPath, marker); err != nil {
+			log.Println("Couldn't record how", marker.VOB, "went for its DVD:", err)
+		}
+	}
+}
+
+// Whether a folder has a non-hidden file whose name starts with the prefix.
+func hasFileStartingWith(folder string, prefix string) bool {
+	files, _ := ioutil.ReadDir(folder)
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether every file in the folder is finished being copied.
+func isDiscFolderSettled(path string) bool {
+	settled := true
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if time.Since(info.ModTime()) < discSettleTime || !canGetExclusiveAccessToFile(file) {
+			settled = false
+		}
+		return nil
+	})
+	return settled
+}
+
+// Picks the title set: as per eg 'DVDTitle2' in the name, otherwise the biggest, which is the longest as DVDs have a fixed-ish bitrate.
+func discTitleSetFor(d *disc, name string) (int, error) {
+	if matches := discTitleRegex.FindStringSubmatch(name); len(matches) >= 2 {
+		requested, _ := strconv.Atoi(matches[1])
+		if _, ok := d.TitleSets[requested]; !ok {
+			return 0, fmt.Errorf("The DVD %s has no title set %d, as asked for in its name", name, requested)
+		}
+		return requested, nil
+	}
+	best, bestSize := 0, int64(-1)
+	for titleSet, vobs := range d.TitleSets {
+		size := int64(0)
+		for _, vob := range vobs {
+			size += vob.Size
+		}
+		if size > bestSize || (size == bestSize && titleSet < best) {
+			best, bestSize = titleSet, size
+		}
+	}
+	return best, nil
+}
+
+// The name for the extracted VOB: the dropped name, or if that's something generic like 'VIDEO_TS' or 'DVD1', a title from the volume label.
+func discOutputName(name string, label string, isISO bool) string {
+	base := name
+	if isISO {
+		base = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if discGenericNameRegex.MatchString(base) && !discGenericNameRegex.MatchString(label) {
+		if hint := discTitleHint(label); hint != "" {
+			return hint
+		}
+	}
+	return base
+}
+
+// Eg 'BIG_BUCK_BUNNY_DISC_1' becomes 'Big Buck Bunny'. Returns "" if there's nothing but the disc number, eg 'DISC_1'.
+func discTitleHint(label string) string {
+	label = discNumberRegex.ReplaceAllString(label, "")
+	words := strings.FieldsFunc(label, func(r rune) bool { return r == '_' || r == ' ' || r == '.' })
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + strings.ToLower(word[1:])
+	}
+	return strings.Join(words, " ")
+}
+
+// The input for ffmpeg. VOBs that follow on from each other in an ISO (as they usually do) are read as one subfile.
+func discConcatURL(vobs []discVOB) string {
+	if len(vobs) > 1 && strings.HasPrefix(vobs[0].URL, "subfile,") {
+		contiguous := true
+		for i := 1; i < len(vobs); i++ {
+			if vobs[i].Offset != vobs[i-1].Offset+vobs[i-1].Size {
+				contiguous = false
+			}
+		}
+		if contiguous {
+			last := vobs[len(vobs)-1]
+			isoPath := vobs[0].URL[strings.Index(vobs[0].URL, ",,:")+3:]
+			return isoSubfileURL(isoPath, vobs[0].Offset, last.Offset+last.Size)
+		}
+	}
+	urls := make([]string, 0)
+	for _, vob := range vobs {
+		urls = append(urls, vob.URL)
+	}
+	return "concat:" + strings.Join(urls, "|")
+}
+
+func isoSubfileURL(isoPath string, start int64, end int64) string {
+	return fmt.Sprintf("subfile,,start,%d,end,%d,,:%s", start, end, isoPath)
+}
+
+// Finds the title sets in a VIDEO_TS folder.
+func readFolderDisc(videoTSFolder string) (*disc, error) {
+	files, err := ioutil.ReadDir(videoTSFolder)
+	if err != nil {
+		return nil, err
+	}
+	d := &disc{TitleSets: make(map[int][]discVOB)}
+	for _, file := range files {
+		if matches := discVOBRegex.FindStringSubmatch(file.Name()); len(matches) >= 3 {
+			titleSet, _ := strconv.Atoi(matches[1])
+			d.TitleSets[titleSet] = append(d.TitleSets[titleSet], discVOB{
+				Name: file.Name(),
+				URL:  filepath.Join(videoTSFolder, file.Name()),
+				Size: file.Size(),
+			})
+		}
+	}
+	sortDiscVOBs(d)
+	return d, nil
+}
+
+// Finds the title sets in an ISO, by reading its ISO9660 filesystem. DVDs are UDF, but nearly all have ISO9660 alongside for compatibility.
+func readISODisc(isoPath string) (*disc, error) {
+	file, err := os.Open(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// The primary volume descriptor is at sector 16.
+	pvd := make([]byte, isoSectorSize)
+	if _, err := file.ReadAt(pvd, 16*isoSectorSize); err != nil {
+		return nil, err
+	}
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		return nil, errors.New("No ISO9660 filesystem, UDF-only discs aren't supported")
+	}
+	d := &disc{
+		Label:     strings.TrimSpace(string(pvd[40:72])),
+		TitleSets: make(map[int][]discVOB),
+	}
+
+	// Find VIDEO_TS in the root.
+	root, err := readISODirectory(file, pvd[156:156+34])
+	if err != nil {
+		return nil, err
+	}
+	var videoTS []byte
+	for _, record := range root {
+		if isoRecordIsDirectory(record) && strings.EqualFold(isoRecordName(record), "VIDEO_TS") {
+			videoTS = record
+		}
+	}
+	if videoTS == nil {
+		return nil, errors.New("No VIDEO_TS folder in the ISO")
+	}
+
+	// List its VOBs.
+	records, err := readISODirectory(file, videoTS)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		name := isoRecordName(record)
+		if matches := discVOBRegex.FindStringSubmatch(name); len(matches) >= 3 && !isoRecordIsDirectory(record) {
+			titleSet, _ := strconv.Atoi(matches[1])
+			offset := int64(binary.LittleEndian.Uint32(record[2:6])) * isoSectorSize
+			size := int64(binary.LittleEndian.Uint32(record[10:14]))
+			d.TitleSets[titleSet] = append(d.TitleSets[titleSet], discVOB{
+				Name:   name,
+				URL:    isoSubfileURL(isoPath, offset, offset+size),
+				Offset: offset,
+				Size:   size,
+			})
+		}
+	}
+	sortDiscVOBs(d)
+	return d, nil
+}
+
+// Reads the records in the directory that the given record describes, skipping '.' and '..'.
+func readISODirectory(file *os.File, record []byte) ([][]byte, error) {
+	extent := int64(binary.LittleEndian.Uint32(record[2:6])) * isoSectorSize
+	size := int64(binary.LittleEndian.Uint32(record[10:14]))
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, extent); err != nil {
+		return nil, err
+	}
+	records := make([][]byte, 0)
+	for offset := 0; offset < len(data); {
+		length := int(data[offset])
+		if length == 0 {
+			// Records don't cross sectors, so the rest of this one is padding.
+			offset = (offset/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if offset+length > len(data) || length < 34 {
+			return nil, errors.New("Bad directory record in the ISO")
+		}
+		entry := data[offset : offset+length]
+		nameLength := int(entry[32])
+		if 33+nameLength <= len(entry) && !(nameLength == 1 && (entry[33] == 0 || entry[33] == 1)) {
+			records = append(records, entry)
+		}
+		offset += length
+	}
+	return records, nil
+}
+
+// Eg 'VTS_01_1.VOB', without the ';1' version.
+func isoRecordName(record []byte) string {
+	nameLength := int(record[32])
+	name := string(record[33 : 33+nameLength])
+	return strings.Split(name, ";")[0]
+}
+
+func isoRecordIsDirectory(record []byte) bool {
+	return record[25]&2 != 0
+}
+
+// VTS_01_1, VTS_01_2, etc.
+func sortDiscVOBs(d *disc) {
+	for _, vobs := range d.TitleSets {
+		sort.Slice(vobs, func(i, j int) bool { return strings.ToUpper(vobs[i].Name) < strings.ToUpper(vobs[j].Name) })
+	}
+}
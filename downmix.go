@@ -0,0 +1,38 @@
+package main
+
+import "log"
+
+// Pan filters for downmixing to stereo, keyed by ffprobe's channel layout.
+// These fold every channel in, keeping the bass (LFE) and speech (FC), whereas ffmpeg's default `-ac 2` is quiet and drops the LFE.
+// The '<' means the gains are normalised so it doesn't clip.
+var downmixMatrices = map[string]string{
+	"mono":           "pan=stereo|FL=FC|FR=FC",
+	"2.1":            "pan=stereo|FL<FL+LFE|FR<FR+LFE",                     // FL+FR+LFE
+	"3.0":            "pan=stereo|FL<FL+FC|FR<FR+FC",                       // FL+FR+FC
+	"4.0":            "pan=stereo|FL<FL+FC+BC|FR<FR+FC+BC",                 // FL+FR+FC+BC
+	"quad":           "pan=stereo|FL<FL+BL|FR<FR+BR",                       // FL+FR+BL+BR
+	"quad(side)":     "pan=stereo|FL<FL+SL|FR<FR+SR",                       // FL+FR+SL+SR
+	"5.0":            "pan=stereo|FL<FL+BL+FC|FR<FR+BR+FC",                 // FL+FR+FC+BL+BR
+	"5.0(side)":      "pan=stereo|FL<FL+SL+FC|FR<FR+SR+FC",                 // FL+FR+FC+SL+SR
+	"5.1":            "pan=stereo|FL<FL+BL+FC+LFE|FR<FR+BR+FC+LFE",         // FL+FR+FC+LFE+BL+BR
+	"5.1(side)":      "pan=stereo|FL<FL+SL+FC+LFE|FR<FR+SR+FC+LFE",         // FL+FR+FC+LFE+SL+SR
+	"6.1":            "pan=stereo|FL<FL+SL+BC+FC+LFE|FR<FR+SR+BC+FC+LFE",   // FL+FR+FC+LFE+BC+SL+SR
+	"6.1(back)":      "pan=stereo|FL<FL+BL+BC+FC+LFE|FR<FR+BR+BC+FC+LFE",   // FL+FR+FC+LFE+BL+BR+BC
+	"7.1":            "pan=stereo|FL<FL+SL+BL+FC+LFE|FR<FR+SR+BR+FC+LFE",   // FL+FR+FC+LFE+BL+BR+SL+SR
+	"7.1(wide)":      "pan=stereo|FL<FL+FLC+BL+FC+LFE|FR<FR+FRC+BR+FC+LFE", // FL+FR+FC+LFE+BL+BR+FLC+FRC
+	"7.1(wide-side)": "pan=stereo|FL<FL+FLC+SL+FC+LFE|FR<FR+FRC+SR+FC+LFE", // FL+FR+FC+LFE+FLC+FRC+SL+SR
+}
+
+// Finds the filter for downmixing the given channel layout to stereo, preferring the config's over the built-in one.
+// Logs the chosen matrix. Returns false if there isn't one.
+func downmixFilterFor(channelLayout string, config Config) (string, bool) {
+	if filter, ok := config.Downmix[channelLayout]; ok && filter != "" {
+		log.Printf("Downmixing %s to stereo using the config's matrix: %s", channelLayout, filter)
+		return filter, true
+	}
+	if filter, ok := downmixMatrices[channelLayout]; ok {
+		log.Printf("Downmixing %s to stereo, preserving bass and speech, using: %s", channelLayout, filter)
+		return filter, true
+	}
+	return "", false
+}
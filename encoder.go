@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// How to encode video, when it can't simply be copied.
+// Blank/zero fields are left for ffmpeg to decide.
+type EncoderSettings struct {
+	Codec   string // Eg "libx264".
+	CRF     int    // Eg 21, lower is better quality but bigger.
+	Preset  string // Eg "veryfast", for slow computers.
+	Tune    string // Eg "animation", for cartoons.
+	Profile string // Eg "high", for older devices.
+	Level   string // Eg "4.0", for older devices.
+	Threads int    // Caps how many threads ffmpeg uses, which saves RAM on small boards.
+}
+
+// Returns these settings, with any fields set in the overrides replacing them.
+func (e EncoderSettings) overriddenBy(overrides EncoderSettings) EncoderSettings {
+	if overrides.Codec != "" {
+		e.Codec = overrides.Codec
+	}
+	if overrides.CRF != 0 {
+		e.CRF = overrides.CRF
+	}
+	if overrides.Preset != "" {
+		e.Preset = overrides.Preset
+	}
+	if overrides.Tune != "" {
+		e.Tune = overrides.Tune
+	}
+	if overrides.Profile != "" {
+		e.Profile = overrides.Profile
+	}
+	if overrides.Level != "" {
+		e.Level = overrides.Level
+	}
+	if overrides.Threads != 0 {
+		e.Threads = overrides.Threads
+	}
+	return e
+}
+
+// The ffmpeg args for encoding video with these settings. Doesn't include the threads, as that applies even when copying.
+func (e EncoderSettings) videoArgs() []string {
+	args := make([]string, 0)
+	if e.Codec != "" {
+		args = append(args, "-vcodec", e.Codec)
+	}
+	if e.CRF != 0 {
+		args = append(args, "-crf", strconv.Itoa(e.CRF))
+	}
+	if e.Preset != "" {
+		args = append(args, "-preset", e.Preset)
+	}
+	if e.Tune != "" {
+		args = append(args, "-tune", e.Tune)
+	}
+	if e.Profile != "" {
+		args = append(args, "-profile:v", e.Profile)
+	}
+	if e.Level != "" {
+		args = append(args, "-level", e.Level)
+	}
+	return args
+}
+
+func (e EncoderSettings) threadsArgs() []string {
+	if e.Threads <= 0 {
+		return nil
+	}
+	return []string{"-threads", strconv.Itoa(e.Threads)}
+}
+
+// Figures out the encoder settings for a file: the config's defaults, overridden by the preset named in the filename if any.
+func encoderSettingsFor(inPath string, config Config) (EncoderSettings, error) {
+	name := encoderPresetFromFile(inPath)
+	if name == "" {
+		return config.Encoder, nil
+	}
+	preset, ok := config.EncoderPresets[name]
+	if !ok {
+		return EncoderSettings{}, errors.New("The filename asks for encoder preset '" + name + "', which isn't in your config file")
+	}
+	return config.Encoder.overriddenBy(preset), nil
+}
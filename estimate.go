@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	estimateSampleSeconds = 20  // How much of the source to encode for the benchmark.
+	estimateSampleAt      = 0.3 // Where in the source the sample comes from, as a fraction, so it's past any quick opening titles.
+	confirmedFlag         = "confirmed"
+)
+
+// How long a transcode is expected to take, and how big the output will be, going by a benchmark encode of a sample.
+type TranscodeEstimate struct {
+	Seconds int     // Wall-clock, including the scrubbing previews.
+	Time    string  // Eg '41h20m0s'.
+	Bytes   int64   // Of the video and audio, including any surround rendition, not counting trickplay etc.
+	Speed   float64 // Of the transcode itself, eg 0.05 means it encodes at a twentieth of real-time.
+}
+
+// Eg '41h20m0s at 0.05x, about 2.1GB'.
+func (e TranscodeEstimate) String() string {
+	return fmt.Sprintf("%s at %.2fx, about %.1fGB", e.Time, e.Speed, float64(e.Bytes)/1e9)
+}
+
+// Encodes a sample of the source with the same args as the real transcode, including any surround rendition, and extrapolates from that.
+// The scrubbing previews are benchmarked from the sample too, unless they're skipped.
+// duration is the source's, as per the probe, and remaining is how much of it is left to transcode, which is less if it's resuming.
+// The speeds are as ffmpeg reports them, so don't count its start-up and seeking, which would otherwise swamp a short sample on a slow machine.
+func estimateTranscode(inPath string, duration float64, remaining float64, videoMap string, videoArgs []string, audioStreamIndex int, audioArgs []string, surround *surroundAudio, paths Paths, config Config) (TranscodeEstimate, error) {
+	if duration <= 0 {
+		return TranscodeEstimate{}, errors.New("The duration is unknown")
+	}
+	sample := math.Min(estimateSampleSeconds, duration)
+	start := math.Max(0, math.Min(duration*estimateSampleAt, duration-sample))
+
+	samplePath, err := estimateTempPath(paths)
+	if err != nil {
+		return TranscodeEstimate{}, err
+	}
+	defer os.Remove(samplePath)
+	args := []string{
+		"-ss", fmt.Sprintf("%f", start),
+		"-i", inPath,
+		"-t", fmt.Sprintf("%f", sample),
+		"-map", videoMap,
+		"-map", fmt.Sprintf("0:%d", audioStreamIndex),
+	}
+	args = append(args, videoArgs...)
+	args = append(args, audioArgs...)
+	args = append(args, "-f", "mpegts", "-y", samplePath)
+	var surroundPath string
+	if surround != nil {
+		if surroundPath, err = estimateTempPath(paths); err != nil {
+			return TranscodeEstimate{}, err
+		}
+		defer os.Remove(surroundPath)
+		args = append(args, "-map", fmt.Sprintf("0:%d", surround.StreamIndex), "-vn", "-sn")
+		args = append(args, surround.Args...)
+		args = append(args, "-f", "mpegts", "-y", surroundPath)
+	}
+	speed, err := ffmpegSpeed(args, sample)
+	if err != nil {
+		return TranscodeEstimate{}, err
+	}
+	bytes, err := fileSize(samplePath)
+	if err != nil {
+		return TranscodeEstimate{}, err
+	}
+	if surround != nil {
+		surroundBytes, err := fileSize(surroundPath)
+		if err != nil {
+			return TranscodeEstimate{}, err
+		}
+		bytes += surroundBytes
+	}
+	seconds := math.Max(0, remaining) / speed
+
+	// Trickplay goes over the whole output, even when resuming.
+	if !config.SkipTrickplay {
+		trickplayArgs := []string{"-i", samplePath, "-an", "-sn", "-vf", trickplayFilter(trickplayInterval(config)), "-f", "null", "-"}
+		if trickplaySpeed, err := ffmpegSpeed(trickplayArgs, sample); err != nil {
+			log.Println("Couldn't estimate the time for the scrubbing previews:", err)
+		} else {
+			seconds += duration / trickplaySpeed
+		}
+	}
+
+	estimated := time.Duration(seconds) * time.Second
+	return TranscodeEstimate{
+		Seconds: int(estimated.Seconds()),
+		Time:    estimated.String(),
+		Bytes:   int64(float64(bytes) / sample * duration),
+		Speed:   math.Round(speed*1000) / 1000,
+	}, nil
+}
+
+// An empty temporary file in staging, for a sample.
+func estimateTempPath(paths Paths) (string, error) {
+	tempFile, err := ioutil.TempFile(paths.Staging, "estimate*.ts")
+	if err != nil {
+		return "", err
+	}
+	tempFile.Close()
+	return tempFile.Name(), nil
+}
+
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Runs ffmpeg, and returns the last speed it reported, eg 0.05 for a twentieth of real-time.
+// Falls back to the wall-clock time for the given seconds of media if it didn't report one, eg because it was too quick.
+func ffmpegSpeed(args []string, seconds float64) (float64, error) {
+	began := time.Now()
+	output, err := ffmpeg(args)
+	if err != nil {
+		return 0, err
+	}
+	if matches := ffmpegSpeedRegex.FindAllStringSubmatch(output, -1); len(matches) > 0 {
+		if speed, err := strconv.ParseFloat(matches[len(matches)-1][1], 64); err == nil && speed > 0 {
+			return speed, nil
+		}
+	}
+	return seconds / math.Max(time.Since(began).Seconds(), 0.001), nil
+}
+
+// Whether the user has said to go ahead with a long transcode, eg 'Movie.confirmed.vob'.
+func isConfirmedFile(inPath string) bool {
+	return strings.Contains(filepath.Base(inPath), confirmedFlag)
+}
+
+// Renames a source that'd take too long, so the user has to confirm it by renaming it back, keeping the 'confirmed' flag.
+// Eg 'Movie.vob' becomes 'Movie.confirmed.vob.estimated 41h20m0s, remove this to go ahead'.
+func holdForConfirmation(inPath string, estimate TranscodeEstimate) error {
+	ext := filepath.Ext(inPath) // Eg '.vob'
+	nameSansExt := strings.TrimSuffix(inPath, ext)
+	newName := nameSansExt + "." + confirmedFlag + ext + ".estimated " + estimate.Time + ", remove this to go ahead"
+	if err := os.Rename(inPath, newName); err != nil {
+		return err
+	}
+	return &convertRenamedError{text: "The transcode is estimated to take " + estimate.String()}
+}
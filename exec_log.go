@@ -26,6 +26,12 @@ func scanCarriageReturns(data []byte, atEOF bool) (advance int, token []byte, er
 
 /// Executes, logging lines as they come in, returning all stdin/err output.
 func execLog(command string, args []string) (string, error) {
+	return execLogWatching(command, args, nil)
+}
+
+/// Same as execLog, but also passes each line to onLine (if not nil) as it comes in, eg for tracking progress.
+/// onLine is called from separate goroutines for stdout and stderr.
+func execLogWatching(command string, args []string, onLine func(string)) (string, error) {
 	cmd := exec.Command(command, args...)
 	output := ""
 
@@ -43,6 +49,9 @@ func execLog(command string, args []string) (string, error) {
 			text := stdoutScanner.Text()
 			output = output + text
 			log.Println(strings.TrimSpace(text))
+			if onLine != nil {
+				onLine(text)
+			}
 		}
 	}()
 
@@ -60,6 +69,9 @@ func execLog(command string, args []string) (string, error) {
 			text := stderrScanner.Text()
 			output = output + text
 			log.Println(strings.TrimSpace(text))
+			if onLine != nil {
+				onLine(text)
+			}
 		}
 	}()
 
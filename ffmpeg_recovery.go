@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+// A way to recover from an ffmpeg failure: if its output contains any of the patterns, retry with the extra args.
+type ffmpegRecovery struct {
+	Name       string
+	Patterns   []string // Case-insensitive.
+	InputArgs  []string // Go before the -i.
+	OutputArgs []string // Go after the codec args.
+	CopyOnly   bool     // Only for copying video, eg a bitstream filter, so it's dropped when re-encoding.
+}
+
+// The known recoverable failures, tried in order. Each one that applies is added to the ones before it.
+// These can't simply always be used, as some of them fail or hurt quality when they aren't needed.
+var ffmpegRecoveries = []ffmpegRecovery{
+	{
+		Name:       "h264_mp4toannexb bitstream filter",
+		Patterns:   []string{"h264_mp4toannexb"},
+		OutputArgs: []string{"-bsf:v", "h264_mp4toannexb"},
+		CopyOnly:   true,
+	},
+	{
+		Name:       "bigger muxing queue",
+		Patterns:   []string{"Too many packets buffered for output stream"},
+		OutputArgs: []string{"-max_muxing_queue_size", "9999"},
+	},
+	{
+		Name:      "regenerating timestamps",
+		Patterns:  []string{"non monotonically increasing dts", "non-monotonous dts", "non monotonous dts"},
+		InputArgs: []string{"-fflags", "+genpts"},
+	},
+	{
+		Name:      "ignoring corrupt data",
+		Patterns:  []string{"corrupt", "error while decoding", "invalid data found when processing input"},
+		InputArgs: []string{"-err_detect", "ignore_err"},
+	},
+}
+
+// Finds the first recovery that matches ffmpeg's output, and hasn't been tried yet. Returns nil if there are none.
+func ffmpegRecoveryFor(output string, tried map[string]bool) *ffmpegRecovery {
+	output = strings.ToLower(output)
+	for i, recovery := range ffmpegRecoveries {
+		if tried[recovery.Name] {
+			continue
+		}
+		for _, pattern := range recovery.Patterns {
+			if strings.Contains(output, strings.ToLower(pattern)) {
+				return &ffmpegRecoveries[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Finds the recovery with the given name, eg as recorded in a resume manifest. Returns nil if there's no such recovery.
+func ffmpegRecoveryNamed(name string) *ffmpegRecovery {
+	for i, recovery := range ffmpegRecoveries {
+		if recovery.Name == name {
+			return &ffmpegRecoveries[i]
+		}
+	}
+	return nil
+}
+
+// The input and output args of all the recoveries, in order. If reencoding, the copy-only ones are left out.
+func ffmpegRecoveryArgs(recoveries []*ffmpegRecovery, reencoding bool) ([]string, []string) {
+	var inputArgs, outputArgs []string
+	for _, recovery := range recoveries {
+		if reencoding && recovery.CopyOnly {
+			continue
+		}
+		inputArgs = append(inputArgs, recovery.InputArgs...)
+		outputArgs = append(outputArgs, recovery.OutputArgs...)
+	}
+	return inputArgs, outputArgs
+}
+
+// Whether the args copy rather than encode, eg '-vcodec copy', so re-encoding is a possible fix.
+func isCopying(args []string) bool {
+	for i, arg := range args {
+		if (arg == "-vcodec" || arg == "-acodec" || arg == "-c:v" || arg == "-c:a") && i+1 < len(args) && args[i+1] == "copy" {
+			return true
+		}
+	}
+	return false
+}
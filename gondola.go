@@ -17,6 +17,8 @@ const (
 	metadataFilename      = "metadata.json"
 	hlsFilename           = "hls.m3u8" // This is only a few lines, so the framerate can be set.
 	hlsSegmentsFilename   = "seg.m3u8" // This is the main shebang.
+	hlsInitFilename       = "init.mp4" // Only for fmp4 segments.
+	chaptersFilename      = "chapters.vtt"
 )
 
 // Returns true if it's an extension we're interested in.
@@ -51,9 +53,19 @@ func scanNewPath(whichPath string, isMovies bool, paths Paths, config Config) {
 				if isValidExtension(ext) {
 					log.Println("Found file", file.Name())
 					tryProcess(whichPath, file.Name(), isMovies, paths, config)
+				} else if strings.EqualFold(ext, ".iso") {
+					log.Println("Found DVD image", file.Name())
+					tryProcessDisc(whichPath, file.Name(), isMovies, paths, config)
+				} else if strings.HasSuffix(strings.ToLower(file.Name()), episodesSidecarSuffix) {
+					log.Println("Found episode chapters", file.Name(), "which will be used when splitting their video")
+				} else if isSidecarSubtitleExtension(ext) {
+					log.Println("Found subtitles", file.Name(), "which will be processed along with their video")
 				} else {
 					log.Println("Ignoring file with unexpected extension", file.Name())
 				}
+			} else if isVideoTSFolder(filepath.Join(whichPath, file.Name())) {
+				log.Println("Found DVD folder", file.Name())
+				tryProcessDisc(whichPath, file.Name(), isMovies, paths, config)
 			} else {
 				log.Println("Unexpected, found a directory", file.Name())
 			}
@@ -61,11 +73,28 @@ func scanNewPath(whichPath string, isMovies bool, paths Paths, config Config) {
 	}
 }
 
+var rescanRequests = make(chan struct{}, 1)
+
+// Scans the new paths again after a while, eg when something's still being copied but there won't be a change to trigger a scan.
+func requestRescanAfter(delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		select {
+		case rescanRequests <- struct{}{}:
+		default: // One is already pending.
+		}
+	})
+}
+
 // Tries processing a file. Doesn't worry if it can't, eg if the file is half-copied, as the completion of the copy will trigger another scan.
 func tryProcess(folder string, file string, isMovies bool, paths Paths, config Config) {
 	source := filepath.Join(folder, file)
+	if !exists(source) {
+		return // Eg it was another part of a movie that's already been joined.
+	}
 	if canGetExclusiveAccessToFile(source) {
-		if isMovies {
+		if isMovies && isMoviePartFile(file) { // Eg 'Movie.2001.CD1.avi', which is joined with the other parts first.
+			joinMovieParts(folder, file, paths, config)
+		} else if isMovies {
 			processMovie(folder, file, paths, config)
 		} else {
 			processTV(folder, file, paths, config)
@@ -101,6 +130,19 @@ func exists(path string) bool {
 }
 
 func main() {
+	// Eg 'gondola worker http://gondola.local:8077' runs as a worker for another machine's daemon, so it doesn't need a config.
+	if len(os.Args) >= 2 && os.Args[1] == "worker" {
+		if len(os.Args) < 3 {
+			log.Fatal("Usage: " + workerTokenEnvironment + "=<the daemon's workerToken> gondola worker http://daemon-address:port")
+		}
+		token := os.Getenv(workerTokenEnvironment)
+		if token == "" {
+			log.Fatal("Set " + workerTokenEnvironment + " to the daemon's workerToken")
+		}
+		runWorker(os.Args[2], token)
+		return
+	}
+
 	config, configErr := loadConfig()
 	if configErr != nil {
 		log.Fatal(configErr)
@@ -130,12 +172,15 @@ func main() {
 	os.MkdirAll(paths.Root, os.ModePerm) // This will cause permission issues on a non-FAT mount eg local drive.
 	os.MkdirAll(paths.NewMovies, os.ModePerm)
 	os.MkdirAll(paths.NewTV, os.ModePerm)
-	os.RemoveAll(paths.Staging) // Clear the staging folder on startup. Warning - this'll remove any in-progress source files. The idea is that those files vanish when complete anyway so this should be fine.
 	os.MkdirAll(paths.Staging, os.ModePerm)
+	tidyStaging(paths) // Clear the staging folder on startup, apart from partial transcodes that can be resumed.
 	os.MkdirAll(paths.Movies, os.ModePerm)
 	os.MkdirAll(paths.TV, os.ModePerm)
+	tidyPartialEpisodes(paths) // Likewise for episodes, which are transcoded in place.
 	os.MkdirAll(paths.Failed, os.ModePerm)
 
+	startWorkerServer(config, paths)
+
 	// When starting, re-gen metadata in case user manually moved stuff, and scan for new files.
 	generateMetadata(paths)
 	scanNewPaths(paths, config)
@@ -145,7 +190,11 @@ func main() {
 	changes := watch(folders)
 	log.Println("Watching for changes in " + paths.NewBase)
 	for {
-		<-changes
+		select {
+		case <-changes:
+		case <-rescanRequests:
+			log.Println("Rescanning")
+		}
 		scanNewPaths(paths, config)
 	}
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The RFC 6381 codec string for a stream, as the master playlist's CODECS wants. Eg 'avc1.640028' or 'mp4a.40.2'.
+// Returns "" if it's not one we know how to describe.
+func hlsCodecFor(stream ProbeStream) string {
+	switch stream.Codec_name {
+	case "h264":
+		profiles := map[string]string{
+			"Constrained Baseline":  "42E0",
+			"Baseline":              "4200",
+			"Main":                  "4D40",
+			"Extended":              "5800",
+			"High":                  "6400",
+			"High 10":               "6E00",
+			"High 4:2:2":            "7A00",
+			"High 4:4:4 Predictive": "F400",
+		}
+		profile, ok := profiles[stream.Profile]
+		if !ok || stream.Level <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("avc1.%s%02X", profile, stream.Level)
+	case "hevc":
+		// ffprobe's level for HEVC is already the general_level_idc, eg 120 for level 4.
+		tag := "hvc1"
+		if stream.Codec_tag_string == "hev1" {
+			tag = "hev1"
+		}
+		if stream.Level <= 0 {
+			return ""
+		}
+		switch stream.Profile {
+		case "Main":
+			return fmt.Sprintf("%s.1.6.L%d.B0", tag, stream.Level)
+		case "Main 10":
+			return fmt.Sprintf("%s.2.4.L%d.B0", tag, stream.Level)
+		}
+		return ""
+	case "aac":
+		switch stream.Profile {
+		case "HE-AAC":
+			return "mp4a.40.5"
+		case "HE-AACv2":
+			return "mp4a.40.29"
+		}
+		return "mp4a.40.2" // LC, which is what ffmpeg makes.
+	case "ac3":
+		return "ac-3"
+	case "eac3":
+		return "ec-3"
+	case "mp3":
+		return "mp4a.40.34"
+	}
+	return ""
+}
+
+// The CODECS for a variant, describing all the video and audio streams that were actually produced.
+// Returns "" if any can't be described, as it's better to leave CODECS out than to get it wrong.
+func hlsCodecsFor(result *ProbeResult) string {
+	codecs := make([]string, 0)
+	for _, stream := range append(result.videoStreams(), result.audioStreams()...) {
+		codec := hlsCodecFor(stream)
+		if codec == "" {
+			return ""
+		}
+		codecs = append(codecs, codec)
+	}
+	return strings.Join(codecs, ",")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	verifyDurationToleranceSeconds = 2    // The segments' total duration may be this far from the source's...
+	verifyDurationToleranceRatio   = 0.01 // ...or this fraction of it, whichever is more, as the ends are rarely exact.
+)
+
+// Checks the HLS output is complete before the source is deleted: that its playlist is finished, every segment is there and non-empty,
+// and they add up to the source's duration. If sampleDecode, the first, middle and last segments are also decoded.
+// expectedDuration is best taken from what ffmpeg decoded. If it's only ffprobe's guess (eg for a VOB), durationIsEstimated means a mismatch is only logged.
+func verifyHLS(outFolder string, expectedDuration float64, durationIsEstimated bool, sampleDecode bool) error {
+	playlist, err := readMediaPlaylist(filepath.Join(outFolder, hlsSegmentsFilename))
+	if err != nil {
+		return fmt.Errorf("Couldn't read the segments playlist - %v", err)
+	}
+	if !playlist.Ended {
+		return errors.New("The segments playlist isn't finished, it has no EXT-X-ENDLIST")
+	}
+	if len(playlist.Segments) == 0 {
+		return errors.New("The segments playlist has no segments")
+	}
+
+	// Every segment, and the init segment if fMP4, must be there.
+	isFMP4 := !strings.HasSuffix(playlist.Segments[0].URI, ".ts")
+	if isFMP4 && !isNonEmptyFile(filepath.Join(outFolder, hlsInitFilename)) {
+		return errors.New("The init segment is missing or empty")
+	}
+	total := 0.0
+	for _, segment := range playlist.Segments {
+		if !isNonEmptyFile(filepath.Join(outFolder, segment.URI)) {
+			return errors.New("Segment " + segment.URI + " is missing or empty")
+		}
+		total += segment.Duration
+	}
+
+	// They should add up to the source.
+	if expectedDuration > 0 {
+		tolerance := math.Max(verifyDurationToleranceSeconds, expectedDuration*verifyDurationToleranceRatio)
+		if math.Abs(total-expectedDuration) > tolerance {
+			if !durationIsEstimated {
+				return fmt.Errorf("The segments add up to %.1fs, but the source is %.1fs", total, expectedDuration)
+			}
+			log.Printf("The segments add up to %.1fs, but the source's estimated duration is %.1fs, which isn't reliable so carrying on", total, expectedDuration)
+		}
+	}
+	log.Printf("Verified %d segments totalling %.1fs", len(playlist.Segments), total)
+
+	if sampleDecode {
+		samples := []mediaSegment{playlist.Segments[0], playlist.Segments[len(playlist.Segments)/2], playlist.Segments[len(playlist.Segments)-1]}
+		for _, segment := range samples {
+			if err := decodeSegment(outFolder, segment, isFMP4); err != nil {
+				return fmt.Errorf("Segment %s doesn't decode - %v", segment.URI, err)
+			}
+		}
+		log.Println("Sample segments decoded fine")
+	}
+	return nil
+}
+
+// Decodes a segment, failing on the first error. fMP4 segments can't be decoded without their init segment, so it's prepended.
+func decodeSegment(outFolder string, segment mediaSegment, isFMP4 bool) error {
+	input := filepath.Join(outFolder, segment.URI)
+	if isFMP4 {
+		input = "concat:" + filepath.Join(outFolder, hlsInitFilename) + "|" + input
+	}
+	_, err := ffmpeg([]string{"-v", "error", "-xerror", "-i", input, "-f", "null", "-"})
+	return err
+}
+
+// Explains why the source is being moved to the Failed folder, in a text file next to it.
+func writeFailedReason(inPath string, paths Paths, reason string) {
+	path := filepath.Join(paths.Failed, filepath.Base(inPath)+".reason.txt")
+	if err := os.WriteFile(path, []byte(reason+"\n"), os.ModePerm); err != nil {
+		log.Println("Couldn't write the reason for failing:", err)
+	}
+}
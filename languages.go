@@ -0,0 +1,76 @@
+package main
+
+import "strings"
+
+type language struct {
+	Code string // Two-letter code as HLS wants it, eg "en".
+	Name string // Eg "English".
+}
+
+// Keyed by the ISO 639-2 codes ffprobe reports, both bibliographic (eg 'fre') and terminologic (eg 'fra').
+var languages = map[string]language{
+	"ara": {"ar", "Arabic"},
+	"chi": {"zh", "Chinese"},
+	"zho": {"zh", "Chinese"},
+	"cze": {"cs", "Czech"},
+	"ces": {"cs", "Czech"},
+	"dan": {"da", "Danish"},
+	"dut": {"nl", "Dutch"},
+	"nld": {"nl", "Dutch"},
+	"eng": {"en", "English"},
+	"fin": {"fi", "Finnish"},
+	"fre": {"fr", "French"},
+	"fra": {"fr", "French"},
+	"ger": {"de", "German"},
+	"deu": {"de", "German"},
+	"gre": {"el", "Greek"},
+	"ell": {"el", "Greek"},
+	"heb": {"he", "Hebrew"},
+	"hin": {"hi", "Hindi"},
+	"hun": {"hu", "Hungarian"},
+	"ice": {"is", "Icelandic"},
+	"isl": {"is", "Icelandic"},
+	"ind": {"id", "Indonesian"},
+	"ita": {"it", "Italian"},
+	"jpn": {"ja", "Japanese"},
+	"kor": {"ko", "Korean"},
+	"may": {"ms", "Malay"},
+	"msa": {"ms", "Malay"},
+	"nor": {"no", "Norwegian"},
+	"pol": {"pl", "Polish"},
+	"por": {"pt", "Portuguese"},
+	"rum": {"ro", "Romanian"},
+	"ron": {"ro", "Romanian"},
+	"rus": {"ru", "Russian"},
+	"spa": {"es", "Spanish"},
+	"swe": {"sv", "Swedish"},
+	"tha": {"th", "Thai"},
+	"tur": {"tr", "Turkish"},
+	"ukr": {"uk", "Ukrainian"},
+	"vie": {"vi", "Vietnamese"},
+}
+
+// Finds the language for a three-letter (eg 'eng') or two-letter (eg 'en') code, or a name (eg 'English').
+// Returns false if it's unknown, eg 'und' which ffprobe uses for 'undetermined'.
+func languageFor(code string) (language, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if l, ok := languages[code]; ok {
+		return l, true
+	}
+	for _, l := range languages {
+		if l.Code == code || strings.ToLower(l.Name) == code {
+			return l, true
+		}
+	}
+	return language{}, false
+}
+
+// Are these two codes the same language, regardless of whether they're two or three letter codes?
+func isSameLanguage(a string, b string) bool {
+	la, okA := languageFor(a)
+	lb, okB := languageFor(b)
+	if okA && okB {
+		return la.Code == lb.Code
+	}
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const (
+	loudnessTruePeak = -1.5 // dBTP, the ceiling for peaks, as per EBU R128.
+	loudnessRange    = 11.0 // LU, loudnorm's default.
+)
+
+// What loudnorm measured in its first pass. ffmpeg gives these as strings.
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// The loudnorm filter settings, without the measurements.
+func loudnormTargets(target float64) string {
+	return fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f", target, loudnessTruePeak, loudnessRange)
+}
+
+// The first of the two loudnorm passes: decodes the audio stream through the given filters (eg a downmix),
+// measuring how loud it is. This takes a while, but nowhere near as long as transcoding the video.
+func measureLoudness(inPath string, audioStreamIndex int, filters []string, target float64) (loudnessMeasurement, error) {
+	log.Println("Measuring loudness, for normalising the audio")
+	allFilters := append(append([]string{}, filters...), loudnormTargets(target)+":print_format=json")
+	args := []string{
+		"-i", inPath,
+		"-map", fmt.Sprintf("0:%d", audioStreamIndex),
+		"-af", strings.Join(allFilters, ","),
+		"-f", "null", "-",
+	}
+	output, err := ffmpeg(args)
+	if err != nil {
+		return loudnessMeasurement{}, err
+	}
+
+	// The JSON is the last thing it outputs.
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start < 0 || end < start {
+		return loudnessMeasurement{}, errors.New("Couldn't find loudnorm's measurements in ffmpeg's output")
+	}
+	var measurement loudnessMeasurement
+	if err := json.Unmarshal([]byte(output[start:end+1]), &measurement); err != nil {
+		return loudnessMeasurement{}, err
+	}
+	for _, value := range []string{measurement.InputI, measurement.InputTP, measurement.InputLRA, measurement.InputThresh, measurement.TargetOffset} {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return loudnessMeasurement{}, errors.New("Unusable loudness measurement, maybe it's silent: " + value)
+		}
+	}
+	log.Printf("Measured loudness: %s LUFS, true peak %s dBTP, range %s LU", measurement.InputI, measurement.InputTP, measurement.InputLRA)
+	return measurement, nil
+}
+
+// The second loudnorm pass's filter, which uses the measurements to apply linear normalisation.
+func (m loudnessMeasurement) filter(target float64) string {
+	return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		loudnormTargets(target), m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	fingerprintFilename      = "fingerprint.bin" // The audio fingerprint of the start of an episode, for finding the intro.
+	fingerprintSeconds       = 600               // How much of the start of each episode to fingerprint, as intros are near the start.
+	fingerprintSampleRate    = 8000
+	fingerprintFrameSamples  = 1000 // So 8 frames per second.
+	fingerprintMaxBitErrors  = 8    // Of 32, for two frames to count as the same.
+	fingerprintMaxGap        = 4    // Frames that may not match in the middle of an intro, eg due to a sound effect.
+	introMinimumSeconds      = 15
+	creditsSearchFraction    = 0.2 // Look for the credits in the last 20% of the episode...
+	creditsSearchMaxSeconds  = 300 // ...or the last 5 minutes, whichever is shorter.
+	creditsOnBlackMinSeconds = 10  // Black for longer than this means the credits roll over black, rather than starting after it.
+)
+
+// The bands the fingerprint compares, in Hz. They're roughly where speech and music themes are.
+var fingerprintBands = []float64{200, 250, 315, 400, 500, 630, 800, 1000, 1250, 1600, 2000, 2500, 3150, 3500, 3700, 3850, 3950}
+
+// A part of an episode, in seconds of the HLS output.
+type MarkerRange struct {
+	Start float64
+	End   float64
+}
+
+// Where the intro and credits are, so a player can offer 'skip intro' and 'next episode'.
+type Markers struct {
+	Intro   *MarkerRange `json:",omitempty"`
+	Credits *MarkerRange `json:",omitempty"`
+}
+
+// Finds the markers for a newly transcoded episode: the credits from its own video, and the intro by comparing it to the rest of the season.
+// Other episodes in the season get their intro updated too, if this is the first episode that shares it.
+func findEpisodeMarkers(seasonFolder string, episodeFolder string) {
+	var markers Markers
+	var existing ItemMediaDetails
+	readAndUnmarshal(episodeFolder, metadataFilename, &existing)
+	if existing.Markers != nil {
+		markers = *existing.Markers
+	}
+
+	duration, err := hlsDuration(episodeFolder)
+	if err != nil {
+		log.Println("Couldn't find the episode's duration, so it won't have markers:", err)
+		return
+	}
+
+	// Credits.
+	if credits, err := findCredits(episodeFolder, duration); err != nil {
+		log.Println("Couldn't look for the credits:", err)
+	} else if credits != nil {
+		log.Printf("Credits start at %.1fs", credits.Start)
+		markers.Credits = credits
+	} else {
+		log.Println("Couldn't find where the credits start")
+	}
+
+	// Intro.
+	fingerprint, err := fingerprintAudio(episodeFolder)
+	if err != nil {
+		log.Println("Couldn't fingerprint the audio, so the intro won't be found:", err)
+	} else if err := writeFingerprint(episodeFolder, fingerprint); err != nil {
+		log.Println("Couldn't save the fingerprint:", err)
+	}
+	if fingerprint != nil {
+		if intro, otherFolder, otherIntro := findIntro(seasonFolder, episodeFolder, fingerprint); intro != nil {
+			log.Printf("Intro is from %.1fs to %.1fs, as per %s", intro.Start, intro.End, filepath.Base(otherFolder))
+			markers.Intro = intro
+			updateIntroIfMissing(otherFolder, otherIntro)
+		} else {
+			log.Println("Couldn't find an intro shared with other episodes in this season")
+		}
+	}
+
+	if err := mergeIntoItemMetadata(episodeFolder, "Markers", markers); err != nil {
+		log.Println("Couldn't record the markers in the metadata:", err)
+	}
+}
+
+// The duration of an item's HLS, as per its segments.
+func hlsDuration(folder string) (float64, error) {
+	playlist, err := readMediaPlaylist(filepath.Join(folder, hlsSegmentsFilename))
+	if err != nil {
+		return 0, err
+	}
+	duration := 0.0
+	for _, segment := range playlist.Segments {
+		duration += segment.Duration
+	}
+	if duration <= 0 {
+		return 0, errors.New("No segments")
+	}
+	return duration, nil
+}
+
+// Gives another episode the intro it shares with this one, unless it already has one.
+func updateIntroIfMissing(folder string, intro *MarkerRange) {
+	var details ItemMediaDetails
+	readAndUnmarshal(folder, metadataFilename, &details)
+	markers := Markers{}
+	if details.Markers != nil {
+		markers = *details.Markers
+	}
+	if markers.Intro != nil {
+		return
+	}
+	markers.Intro = intro
+	if err := mergeIntoItemMetadata(folder, "Markers", markers); err != nil {
+		log.Println("Couldn't record the intro in the metadata of", folder, "-", err)
+	}
+}
+
+// Credits.
+
+var (
+	blackDetectRegex   = regexp.MustCompile(`black_start:\s*([\d.]+)\s+black_end:\s*([\d.]+)`)
+	silenceDetectRegex = regexp.MustCompile(`silence_start:\s*([\d.]+)[\s\S]*?silence_end:\s*([\d.]+)`)
+)
+
+// Finds where the credits start, by looking near the end for a fade to black that happens with silence.
+// Returns nil if there's no such moment.
+func findCredits(folder string, duration float64) (*MarkerRange, error) {
+	window := math.Min(duration*creditsSearchFraction, creditsSearchMaxSeconds)
+	windowStart := duration - window
+	args := []string{
+		"-ss", fmt.Sprintf("%f", windowStart),
+		"-i", filepath.Join(folder, hlsSegmentsFilename),
+		"-vf", "blackdetect=d=0.5:pic_th=0.9",
+		"-af", "silencedetect=n=-50dB:d=0.5",
+		"-f", "null", "-",
+	}
+	output, err := ffmpeg(args)
+	if err != nil {
+		return nil, err
+	}
+	blacks := rangesFromDetection(blackDetectRegex, output, windowStart)
+	silences := rangesFromDetection(silenceDetectRegex, output, windowStart)
+
+	// The earliest black that's also quiet.
+	for _, black := range blacks {
+		for _, silence := range silences {
+			if silence.Start > black.End+1 || silence.End < black.Start-1 {
+				continue
+			}
+			start := black.End
+			if black.End-black.Start >= creditsOnBlackMinSeconds {
+				start = black.Start
+			}
+			return &MarkerRange{Start: start, End: duration}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Parses blackdetect/silencedetect's start and end times from ffmpeg's output. Their times are relative to the seek, so offset is added.
+func rangesFromDetection(regex *regexp.Regexp, output string, offset float64) []MarkerRange {
+	var ranges []MarkerRange
+	for _, match := range regex.FindAllStringSubmatch(output, -1) {
+		start, startErr := strconv.ParseFloat(match[1], 64)
+		end, endErr := strconv.ParseFloat(match[2], 64)
+		if startErr == nil && endErr == nil {
+			ranges = append(ranges, MarkerRange{Start: start + offset, End: end + offset})
+		}
+	}
+	return ranges
+}
+
+// Intro.
+
+// Makes a fingerprint of the start of an episode's audio: one 32-bit hash per frame.
+// The first 16 bits are whether each band is louder than the next, the rest are whether each band got louder since the last frame.
+// Comparing bands rather than their levels means it doesn't matter if one episode is louder than another.
+// Quiet frames are 0, so they never match.
+func fingerprintAudio(folder string) ([]uint32, error) {
+	cmd := exec.Command("nice", "-n", "20", "ffmpeg", "-v", "quiet",
+		"-i", filepath.Join(folder, hlsSegmentsFilename),
+		"-t", strconv.Itoa(fingerprintSeconds),
+		"-vn", "-sn", "-ac", "1", "-ar", strconv.Itoa(fingerprintSampleRate),
+		"-f", "s16le", "-")
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	frameCount := len(data) / 2 / fingerprintFrameSamples
+	if frameCount == 0 {
+		return nil, errors.New("No audio")
+	}
+	fingerprint := make([]uint32, frameCount)
+	samples := make([]float64, fingerprintFrameSamples)
+	previous := make([]float64, len(fingerprintBands))
+	for frame := 0; frame < frameCount; frame++ {
+		for i := range samples {
+			offset := (frame*fingerprintFrameSamples + i) * 2
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(data[offset:]))) / 32768
+		}
+		energies := make([]float64, len(fingerprintBands))
+		total := 0.0
+		for band, frequency := range fingerprintBands {
+			energies[band] = goertzel(samples, frequency, fingerprintSampleRate)
+			total += energies[band]
+		}
+		if total > 1e-3 {
+			var hash uint32
+			for band := 0; band < 16; band++ {
+				if energies[band] > energies[band+1] {
+					hash |= 1 << band
+				}
+				if energies[band] > previous[band] {
+					hash |= 1 << (16 + band)
+				}
+			}
+			fingerprint[frame] = hash
+		}
+		previous = energies
+	}
+	return fingerprint, nil
+}
+
+// The energy of the samples at the given frequency.
+func goertzel(samples []float64, frequency float64, sampleRate float64) float64 {
+	coefficient := 2 * math.Cos(2*math.Pi*frequency/sampleRate)
+	var s1, s2 float64
+	for _, sample := range samples {
+		s0 := sample + coefficient*s1 - s2
+		s2 = s1
+		s1 = s0
+	}
+	return s1*s1 + s2*s2 - coefficient*s1*s2
+}
+
+func writeFingerprint(folder string, fingerprint []uint32) error {
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.LittleEndian, fingerprint); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, fingerprintFilename), buffer.Bytes(), os.ModePerm)
+}
+
+func readFingerprint(folder string) ([]uint32, error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, fingerprintFilename))
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := make([]uint32, len(data)/4)
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, fingerprint)
+	return fingerprint, err
+}
+
+// Compares the fingerprint to the other episodes in the season, to find the longest stretch of audio they share, which is the intro.
+// Returns the intro in this episode, and the episode it matched along with where the intro is in that one, or nil if none is long enough.
+func findIntro(seasonFolder string, episodeFolder string, fingerprint []uint32) (*MarkerRange, string, *MarkerRange) {
+	episodeFolders, err := ioutil.ReadDir(seasonFolder)
+	if err != nil {
+		return nil, "", nil
+	}
+	bestLength := int(introMinimumSeconds * fingerprintSampleRate / fingerprintFrameSamples)
+	var intro, otherIntro *MarkerRange
+	var otherFolder string
+	for _, info := range episodeFolders {
+		folder := filepath.Join(seasonFolder, info.Name())
+		if !info.IsDir() || folder == episodeFolder {
+			continue
+		}
+		other, err := readFingerprint(folder)
+		if err != nil {
+			continue // Not transcoded yet, or from before fingerprinting.
+		}
+		start, otherStart, length := longestSharedRun(fingerprint, other)
+		if length >= bestLength {
+			bestLength = length
+			intro = fingerprintRange(start, length)
+			otherIntro = fingerprintRange(otherStart, length)
+			otherFolder = folder
+		}
+	}
+	return intro, otherFolder, otherIntro
+}
+
+func fingerprintRange(start int, length int) *MarkerRange {
+	secondsPerFrame := float64(fingerprintFrameSamples) / fingerprintSampleRate
+	return &MarkerRange{Start: float64(start) * secondsPerFrame, End: float64(start+length) * secondsPerFrame}
+}
+
+// Finds the longest stretch where the fingerprints match, at any offset between them. Returns its start in each, and its length, in frames.
+func longestSharedRun(a []uint32, b []uint32) (int, int, int) {
+	bestStartA, bestStartB, bestLength := 0, 0, 0
+	for offset := -len(a) + 1; offset < len(b); offset++ { // b's index minus a's.
+		runStart, gap := -1, 0
+		for i := 0; i < len(a); i++ {
+			j := i + offset
+			if j < 0 {
+				continue
+			}
+			if j >= len(b) {
+				break
+			}
+			if a[i] != 0 && b[j] != 0 && bits.OnesCount32(a[i]^b[j]) <= fingerprintMaxBitErrors {
+				if runStart < 0 {
+					runStart = i
+				}
+				gap = 0
+				if length := i - runStart + 1; length > bestLength {
+					bestStartA, bestStartB, bestLength = runStart, runStart+offset, length
+				}
+			} else if runStart >= 0 {
+				gap++
+				if gap > fingerprintMaxGap {
+					runStart, gap = -1, 0
+				}
+			}
+		}
+	}
+	return bestStartA, bestStartB, bestLength
+}
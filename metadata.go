@@ -14,9 +14,10 @@ import (
 )
 
 type Metadata struct {
-	TVShows  []TVShowMetadata
-	Movies   []MovieMetadata
-	Capacity string
+	TVShows     []TVShowMetadata
+	Movies      []MovieMetadata
+	Capacity    string
+	Transcoding []TranscodeStatus // As of when this was generated. Staging/status.json has the latest.
 }
 
 type MovieMetadata struct {
@@ -28,6 +29,8 @@ type MovieMetadata struct {
 	ReleaseDate string
 	Vote        float32
 	Media       string
+	Chapters    []Chapter `json:",omitempty"`
+	ChapterVTT  string    `json:",omitempty"` // WebVTT chapters track, for the player.
 }
 
 type TVShowMetadata struct {
@@ -49,13 +52,22 @@ type TVSeasonMetadata struct {
 }
 
 type TVEpisodeMetadata struct {
-	TVDBId   int
-	Episode  int
-	Name     string
-	Overview string
-	Image    string
-	Media    string
-	AirDate  string
+	TVDBId     int
+	Episode    int
+	Name       string
+	Overview   string
+	Image      string
+	Media      string
+	AirDate    string
+	Chapters   []Chapter `json:",omitempty"`
+	ChapterVTT string    `json:",omitempty"` // WebVTT chapters track, for the player.
+	Markers    *Markers  `json:",omitempty"` // Intro and credits, for 'skip intro' and 'next episode'.
+}
+
+// The parts of an item's metadata.json that come from transcoding it, rather than from TMDB/TVDB.
+type ItemMediaDetails struct {
+	Chapters []Chapter
+	Markers  *Markers
 }
 
 // Generates metadata for everything.
@@ -104,17 +116,26 @@ func generateMetadata(paths Paths) {
 				if err := readAndUnmarshal(epFolder, metadataFilename, &epDetails); err != nil {
 					continue
 				}
+				if exists(filepath.Join(epFolder, resumeManifestFilename)) {
+					continue // It's still being transcoded, or was interrupted.
+				}
+
+				var mediaDetails ItemMediaDetails
+				readAndUnmarshal(epFolder, metadataFilename, &mediaDetails)
 
 				image, _ := filepath.Rel(paths.Root, filepath.Join(epFolder, imageFilename))
 				media, _ := filepath.Rel(paths.Root, filepath.Join(epFolder, hlsFilename))
 				episode := TVEpisodeMetadata{
-					TVDBId:   epDetails.TVDBID,
-					Episode:  epDetails.Episode,
-					Name:     epDetails.Name,
-					Overview: epDetails.Overview,
-					Image:    image,
-					Media:    media,
-					AirDate:  epDetails.AirDate,
+					TVDBId:     epDetails.TVDBID,
+					Episode:    epDetails.Episode,
+					Name:       epDetails.Name,
+					Overview:   epDetails.Overview,
+					Image:      image,
+					Media:      media,
+					AirDate:    epDetails.AirDate,
+					Chapters:   mediaDetails.Chapters,
+					ChapterVTT: relativePathIfExists(paths, epFolder, chaptersFilename),
+					Markers:    mediaDetails.Markers,
 				}
 				season.Episodes = append(season.Episodes, episode)
 			}
@@ -138,6 +159,9 @@ func generateMetadata(paths Paths) {
 			continue
 		}
 
+		var mediaDetails ItemMediaDetails
+		readAndUnmarshal(folder, metadataFilename, &mediaDetails)
+
 		// Create the model.
 		image, _ := filepath.Rel(paths.Root, filepath.Join(folder, imageFilename))
 		backdrop, _ := filepath.Rel(paths.Root, filepath.Join(folder, imageBackdropFilename))
@@ -151,6 +175,8 @@ func generateMetadata(paths Paths) {
 			ReleaseDate: details.ReleaseDate,
 			Vote:        details.VoteAverage,
 			Media:       media,
+			Chapters:    mediaDetails.Chapters,
+			ChapterVTT:  relativePathIfExists(paths, folder, chaptersFilename),
 		}
 		movies = append(movies, movie)
 	}
@@ -158,9 +184,10 @@ func generateMetadata(paths Paths) {
 	// Make the root metadata.
 	capacity := capacity(paths)
 	metadata := Metadata{
-		TVShows:  shows,
-		Movies:   movies,
-		Capacity: capacity,
+		TVShows:     shows,
+		Movies:      movies,
+		Capacity:    capacity,
+		Transcoding: readTranscodeStatuses(paths),
 	}
 
 	// Save.
@@ -183,6 +210,16 @@ func directoriesIn(path string) []string {
 	return directories
 }
 
+// The path of a file relative to the root, or "" if it doesn't exist.
+func relativePathIfExists(paths Paths, folder string, file string) string {
+	path := filepath.Join(folder, file)
+	if !exists(path) {
+		return ""
+	}
+	relative, _ := filepath.Rel(paths.Root, path)
+	return relative
+}
+
 func readAndUnmarshal(folder string, file string, v interface{}) error {
 	path := filepath.Join(folder, file)
 	data, err := ioutil.ReadFile(path)
@@ -192,6 +229,27 @@ func readAndUnmarshal(folder string, file string, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+// Adds a value to an item's metadata.json, leaving everything else in it as-is. Creates the file if needed.
+func mergeIntoItemMetadata(folder string, key string, value interface{}) error {
+	path := filepath.Join(folder, metadataFilename)
+	metadata := make(map[string]json.RawMessage)
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			return err
+		}
+	}
+	valueData, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	metadata[key] = valueData
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, os.ModePerm)
+}
+
 // Sorting.
 
 type ByEpisode []TVEpisodeMetadata
@@ -314,8 +372,10 @@ func generateRootHTML(capacity string, paths Paths) {
 		html += "</tr>"
 	}
 
-	// Add the html trailer.
+	// Add the html trailer, with the live transcoding status.
+	status := strings.Replace(htmlStatus, "STATUS", filepath.Base(paths.Staging)+"/"+statusFilename, -1)
 	end := strings.Replace(htmlEnd, "CAPACITY", capacity, -1)
+	end = strings.Replace(end, "</table>", "</table>\n"+status, 1)
 	html += end
 
 	// Save.
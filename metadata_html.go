@@ -57,6 +57,21 @@ const (
 					<p>NAME</p>
 				</a>
 			</td>`
+	htmlStatus = `
+	<p id="status"></p>
+	<script>
+	function showStatus() {
+		fetch("STATUS", {cache: "no-store"}).then(r => r.json()).then(statuses => {
+			document.getElementById("status").innerText = statuses.map(s =>
+				"Transcoding " + s.Name + ": " + s.Percent.toFixed(1) + "%" +
+				(s.Speed > 0 ? " at " + s.Speed.toFixed(2) + "x, about " + s.ETA + " to go" : "")
+			).join("\n");
+		}).catch(() => {});
+	}
+	showStatus();
+	setInterval(showStatus, 10000);
+	</script>
+`
 	htmlEnd = `
 	</table>
 
@@ -25,8 +25,7 @@ func processMovie(folder string, file string, paths Paths, config Config) error
 	tmdbMovie, tmdbErr := requestTmdbMovieSearch(fileTitle, year)
 	if tmdbErr != nil {
 		log.Println("Failed to find TMDB data for", fileTitle, "error:", tmdbErr)
-		failedPath := filepath.Join(paths.Failed, file) // Move to 'failed'.
-		os.Rename(inPath, failedPath)
+		moveToFailed(inPath, paths)
 		os.RemoveAll(stagingOutputFolder) // Tidy up.
 		return tmdbErr
 	} else {
@@ -41,7 +40,7 @@ func processMovie(folder string, file string, paths Paths, config Config) error
 	getMovieImageIfNeeded(tmdbMovie.BackdropPath, "w1280", stagingOutputFolder, imageBackdropFilename)
 
 	// Convert it.
-	convertErr := convertToHLSAppropriately(inPath, stagingOutputFolder, config)
+	convertErr := convertToHLSWithWorkers(inPath, stagingOutputFolder, config, paths)
 
 	// Fail! Move it to the failed folder.
 	if convertErr != nil {
@@ -50,8 +49,8 @@ func processMovie(folder string, file string, paths Paths, config Config) error
 			log.Println("Failed to convert", file, "; file renamed for user intervention, err:", err)
 		default:
 			log.Println("Failed to convert", file, "; moving to the Failed folder, err:", err)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
+			writeFailedReason(inPath, paths, err.Error())
 		}
 		os.RemoveAll(stagingOutputFolder) // Tidy up.
 		return errors.New("Couldn't convert " + file)
@@ -62,9 +61,12 @@ func processMovie(folder string, file string, paths Paths, config Config) error
 	goodTitle := sanitiseForFilesystem(tmdbMovie.Title) + " " + tmdbMovie.ReleaseDate[:4]
 	goodFolder := filepath.Join(paths.Movies, goodTitle)
 	os.Rename(stagingOutputFolder, goodFolder) // Move the HLS across.
-	os.Remove(inPath)                          // Remove the original file.
+	removeSource(inPath)                       // Remove the original file, and any subtitles that came with it.
 	// Assumption is that the user made a backup of their original from their DVD so doesn't care to lose it.
 
+	// Fill in any images TMDB didn't have.
+	generateMovieStillsIfNeeded(goodFolder)
+
 	generateMetadata(paths)
 
 	return nil
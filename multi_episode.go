@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	episodesSidecarSuffix = ".episodes.txt" // The sidecar that says which chapters are which episodes, eg 'Show S02E05-E08.episodes.txt' for 'Show S02E05-E08.vob'.
+	episodesCommentPrefix = "#"             // Lines in it starting with this are ignored.
+	episodeKeyframeSearch = 30              // Seconds before a chapter boundary to look for a keyframe to cut at.
+	episodeSeekMargin     = 0.001           // Seconds after a keyframe to seek to, so rounding can't land on the one before.
+)
+
+var (
+	multiEpisodeRegex    = regexp.MustCompile(`(?i)S(\d+)E(\d+)-E(\d+)`)                        // Eg 'S02E05-E08'. The second E is needed, so eg 'S01E01-1080p' isn't a range.
+	episodesSidecarRegex = regexp.MustCompile(`(?i)^\s*E?(\d+)\s*[:=]\s*(\d+)\s*-\s*(\d+)\s*$`) // Eg 'E05: 1-6', meaning episode 5 is chapters 1 to 6.
+)
+
+// One episode's part of a multi-episode file.
+type episodeRange struct {
+	Episode      int
+	FirstChapter int // 1-based, inclusive.
+	LastChapter  int
+}
+
+// Returns true if the file is several episodes in one, eg 'Show S02E05-E08.vob'.
+func isMultiEpisodeFile(file string) bool {
+	return multiEpisodeRegex.MatchString(file)
+}
+
+// Splits a multi-episode file (eg a DVD title with 4 episodes) at chapter boundaries, into one file per episode, eg 'Show S02E05.vob'.
+// Each is then processed as a normal episode, so gets its own metadata, HLS and image.
+// The chapters are shared out evenly, unless an '.episodes.txt' sidecar says otherwise.
+// Returns false if it isn't to be split, eg a double episode with no chapters, so it's processed as a normal episode instead.
+func splitMultiEpisodeFile(folder string, file string, paths Paths, config Config) (bool, error) {
+	if !isMultiEpisodeFile(file) {
+		return false, nil
+	}
+	inPath := filepath.Join(folder, file)
+	matches := multiEpisodeRegex.FindStringSubmatch(file)
+	season, _ := strconv.Atoi(matches[1])
+	firstEpisode, _ := strconv.Atoi(matches[2])
+	lastEpisode, _ := strconv.Atoi(matches[3])
+	episodesPath := strings.TrimSuffix(inPath, filepath.Ext(inPath)) + episodesSidecarSuffix
+
+	hasSidecar := exists(episodesPath)
+	fail := func(err error) (bool, error) {
+		log.Println("Couldn't split", file, "into episodes:", err)
+		moveToFailed(inPath, paths)
+		if exists(episodesPath) {
+			os.Rename(episodesPath, filepath.Join(paths.Failed, filepath.Base(episodesPath)))
+		}
+		writeFailedReason(inPath, paths, err.Error())
+		return true, err
+	}
+	if lastEpisode <= firstEpisode && !hasSidecar {
+		log.Println("The episode range", matches[0], "doesn't go upwards, so processing", file, "as one episode")
+		return false, nil
+	}
+	if lastEpisode <= firstEpisode {
+		return fail(fmt.Errorf("The episode range %s doesn't go upwards", matches[0]))
+	}
+
+	// Find the chapters. They're numbered as in the file, including any with invalid times, so the sidecar's numbers match what a player shows.
+	probeResult, err := probe(inPath)
+	if err != nil {
+		return fail(fmt.Errorf("Couldn't probe it - %v", err))
+	}
+	chapterCount := len(probeResult.Chapters)
+	if chapterCount == 0 && !hasSidecar {
+		log.Println(file, "has no chapters to split it by, so processing it as one episode")
+		return false, nil
+	}
+	if chapterCount == 0 {
+		return fail(errors.New("It has no chapters to split it by"))
+	}
+
+	// Figure out which chapters are which episodes.
+	var ranges []episodeRange
+	if hasSidecar {
+		ranges, err = readEpisodesSidecar(episodesPath)
+	} else if ranges, err = evenEpisodeRanges(firstEpisode, lastEpisode, chapterCount); err != nil {
+		log.Println(err, "- so processing", file, "as one episode")
+		return false, nil
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if err := checkEpisodeRanges(ranges, firstEpisode, lastEpisode, chapterCount); err != nil {
+		return fail(err)
+	}
+
+	// Split it. The pieces are hidden until they're all made, so they're not processed half-made.
+	// The video's copied, so each cut is moved back to the keyframe before its chapter boundary, as that's the only place a copy can start.
+	// Episodes that follow on share that keyframe, so they don't overlap.
+	sidecars := sidecarSubtitlesFor(inPath)
+	var pieces []string
+	for _, r := range ranges {
+		start, err := episodeCutAt(inPath, probeResult, r.FirstChapter, true)
+		if err != nil {
+			removeHiddenPieces(folder, pieces)
+			return fail(fmt.Errorf("Couldn't find where episode %d starts - %v", r.Episode, err))
+		}
+		end, err := episodeCutAt(inPath, probeResult, r.LastChapter, false)
+		if err != nil {
+			removeHiddenPieces(folder, pieces)
+			return fail(fmt.Errorf("Couldn't find where episode %d ends - %v", r.Episode, err))
+		}
+		episodeTag := fmt.Sprintf("S%02dE%02d", season, r.Episode)
+		pieceName := strings.Replace(file, matches[0], episodeTag, 1)
+		log.Printf("Splitting out episode %d: chapters %d-%d, %.1fs to %.1fs, as %s", r.Episode, r.FirstChapter, r.LastChapter, start, end, pieceName)
+		if err := cutPiece(inPath, filepath.Join(folder, "."+pieceName), start, end, []string{"-map", "0:v", "-map", "0:a?", "-map", "0:s?", "-c", "copy"}); err != nil {
+			removeHiddenPieces(folder, pieces)
+			return fail(fmt.Errorf("Couldn't split out episode %d - %v", r.Episode, err))
+		}
+		pieces = append(pieces, pieceName)
+
+		// Subtitle sidecars are cut up too.
+		for _, sidecar := range sidecars {
+			sidecarName := filepath.Base(sidecar.Path)
+			if !strings.Contains(sidecarName, matches[0]) {
+				log.Println("Can't tell which episodes the subtitles", sidecarName, "are for, so they won't be split")
+				continue
+			}
+			pieceSidecarName := strings.Replace(sidecarName, matches[0], episodeTag, 1)
+			if err := cutPiece(sidecar.Path, filepath.Join(folder, "."+pieceSidecarName), start, end, nil); err != nil {
+				log.Println("Couldn't split the subtitles", sidecarName, "-", err)
+				continue
+			}
+			pieces = append(pieces, pieceSidecarName)
+		}
+	}
+	for _, piece := range pieces {
+		os.Rename(filepath.Join(folder, "."+piece), filepath.Join(folder, piece))
+	}
+
+	// The pieces have everything now, so the original can go, as with any source.
+	log.Println("Split", file, "into", len(ranges), "episodes, removing it")
+	removeSource(inPath)
+	os.Remove(episodesPath)
+	for _, piece := range pieces {
+		if isValidExtension(filepath.Ext(piece)) {
+			tryProcess(folder, piece, false, paths, config)
+		}
+	}
+	return true, nil
+}
+
+// Checks there's exactly one range for each episode from first to last, and that they fit the chapters without overlapping.
+func checkEpisodeRanges(ranges []episodeRange, firstEpisode int, lastEpisode int, chapterCount int) error {
+	if len(ranges) != lastEpisode-firstEpisode+1 {
+		return fmt.Errorf("There are %d episodes in the '%s' sidecar, but the name says episodes %d-%d", len(ranges), episodesSidecarSuffix, firstEpisode, lastEpisode)
+	}
+	sorted := append([]episodeRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].FirstChapter < sorted[j].FirstChapter })
+	seen := make(map[int]bool)
+	for i, r := range sorted {
+		if r.Episode < firstEpisode || r.Episode > lastEpisode {
+			return fmt.Errorf("Episode %d isn't in the range %d-%d in the name", r.Episode, firstEpisode, lastEpisode)
+		}
+		if seen[r.Episode] {
+			return fmt.Errorf("Episode %d is listed more than once", r.Episode)
+		}
+		seen[r.Episode] = true
+		if r.FirstChapter < 1 || r.LastChapter > chapterCount || r.FirstChapter > r.LastChapter {
+			return fmt.Errorf("Episode %d's chapters %d-%d don't fit the %d chapters", r.Episode, r.FirstChapter, r.LastChapter, chapterCount)
+		}
+		if i > 0 && r.FirstChapter <= sorted[i-1].LastChapter {
+			return fmt.Errorf("Episode %d's chapters %d-%d overlap episode %d's", r.Episode, r.FirstChapter, r.LastChapter, sorted[i-1].Episode)
+		}
+	}
+	return nil
+}
+
+// Where to cut for the start or end of the given chapter (1-based, as numbered in the file), in seconds from the start of the file.
+// The end of the last chapter is the end of the file, so it's left as is, but any other boundary is moved back to the keyframe before it.
+func episodeCutAt(inPath string, probeResult *ProbeResult, chapter int, isStart bool) (float64, error) {
+	start, end, ok := probeResult.Chapters[chapter-1].times()
+	if !ok {
+		return 0, fmt.Errorf("Chapter %d's times are invalid", chapter)
+	}
+	offset := probeResult.Format.startSeconds()
+	boundary := math.Max(0, end-offset)
+	if isStart {
+		boundary = math.Max(0, start-offset)
+	} else if chapter == len(probeResult.Chapters) {
+		return boundary, nil
+	}
+	if boundary == 0 {
+		return 0, nil
+	}
+
+	// Find the last keyframe at or before the boundary.
+	from := offset + math.Max(0, boundary-episodeKeyframeSearch)
+	to := offset + boundary + resumeKeyframeTolerance
+	out, err := exec.Command("ffprobe", "-v", "quiet", "-select_streams", "v:0", "-read_intervals", fmt.Sprintf("%f%%%f", from, to),
+		"-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", inPath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("Couldn't find the keyframes - %v", err)
+	}
+	keyframe := -1.0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.Contains(fields[1], "K") {
+			continue
+		}
+		if pts, err := strconv.ParseFloat(fields[0], 64); err == nil && pts-offset <= boundary+resumeKeyframeTolerance {
+			keyframe = math.Max(keyframe, pts-offset)
+		}
+	}
+	if keyframe < 0 {
+		return 0, fmt.Errorf("There's no keyframe in the %ds before %.1fs", episodeKeyframeSearch, boundary)
+	}
+	if boundary-keyframe > resumeKeyframeTolerance {
+		log.Printf("Cutting at the keyframe at %.3fs rather than chapter %d's boundary at %.3fs", keyframe, chapter, boundary)
+	}
+	return keyframe, nil
+}
+
+// Cuts out part of a file, from start to end in seconds. Copying can only start at a keyframe, so start should be one.
+func cutPiece(inPath string, outPath string, start float64, end float64, args []string) error {
+	allArgs := []string{"-ss", fmt.Sprintf("%f", start+episodeSeekMargin), "-i", inPath, "-t", fmt.Sprintf("%f", end-start)}
+	allArgs = append(append(allArgs, args...), "-y", outPath)
+	if _, err := ffmpeg(allArgs); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+func removeHiddenPieces(folder string, pieces []string) {
+	for _, piece := range pieces {
+		os.Remove(filepath.Join(folder, "."+piece))
+	}
+}
+
+// Shares the chapters evenly between the episodes, eg 24 chapters for episodes 5-8 is 6 each.
+func evenEpisodeRanges(firstEpisode int, lastEpisode int, chapterCount int) ([]episodeRange, error) {
+	episodeCount := lastEpisode - firstEpisode + 1
+	if chapterCount%episodeCount != 0 {
+		return nil, fmt.Errorf("Its %d chapters can't be shared evenly between %d episodes without an '%s' sidecar to say which chapters are which episodes", chapterCount, episodeCount, episodesSidecarSuffix)
+	}
+	perEpisode := chapterCount / episodeCount
+	ranges := make([]episodeRange, 0)
+	for i := 0; i < episodeCount; i++ {
+		ranges = append(ranges, episodeRange{Episode: firstEpisode + i, FirstChapter: i*perEpisode + 1, LastChapter: (i + 1) * perEpisode})
+	}
+	return ranges, nil
+}
+
+// Reads an '.episodes.txt' sidecar, which has a line per episode like 'E05: 1-6', meaning episode 5 is chapters 1 to 6.
+func readEpisodesSidecar(path string) ([]episodeRange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ranges := make([]episodeRange, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, episodesCommentPrefix) {
+			continue
+		}
+		matches := episodesSidecarRegex.FindStringSubmatch(line)
+		if len(matches) < 4 {
+			return nil, fmt.Errorf("Couldn't understand '%s' in %s, expecting eg 'E05: 1-6'", line, filepath.Base(path))
+		}
+		episode, _ := strconv.Atoi(matches[1])
+		first, _ := strconv.Atoi(matches[2])
+		last, _ := strconv.Atoi(matches[3])
+		ranges = append(ranges, episodeRange{Episode: episode, FirstChapter: first, LastChapter: last})
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("No episodes in " + filepath.Base(path))
+	}
+	return ranges, scanner.Err()
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// All of a movie's parts must be untouched for this long before they're joined, in case more are still on the way.
+const partSettleTime = 2 * time.Minute
+
+var (
+	partRegex     = regexp.MustCompile(`(?i)[ ._-]+(cd|part|pt)[ ._-]?(\d+)$`)  // Eg '.CD1', ' part 2', '-pt3'. It has to be at the end of the name, so eg 'The Godfather Part 2 1974' is left alone.
+	partYearRegex = regexp.MustCompile(`(^|[ ._(\[-])(19|20)\d\d([ ._)\]-]|$)`) // 'Part' is only a part marker after a year, so eg 'Harry Potter and the Deathly Hallows Part 2' is a film of its own.
+)
+
+// One part of a multi-part movie, eg 'Movie.2001.CD2.avi'.
+type moviePart struct {
+	File   string
+	Number int
+}
+
+// Returns true if it's one part of a movie, eg 'Movie.2001.CD1.avi'.
+func isMoviePartFile(file string) bool {
+	_, ok := moviePartNumber(file)
+	return ok
+}
+
+// The part number, eg 2 for 'Movie.2001.CD2.avi', and whether it's a part at all.
+func moviePartNumber(file string) (int, bool) {
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+	matches := partRegex.FindStringSubmatch(name)
+	if len(matches) < 3 {
+		return 0, false
+	}
+	if strings.EqualFold(matches[1], "part") && !partYearRegex.MatchString(strings.TrimSuffix(name, matches[0])) {
+		return 0, false
+	}
+	number, _ := strconv.Atoi(matches[2])
+	return number, true
+}
+
+// The name of the whole movie, without the part marker, eg 'Movie.2001.CD1.avi' is 'Movie.2001.avi'.
+func joinedMovieName(file string) string {
+	extension := filepath.Ext(file)
+	return partRegex.ReplaceAllString(strings.TrimSuffix(file, extension), "") + extension
+}
+
+// Joins the parts of a movie (eg CD1 and CD2) into one file, then processes that as usual.
+// It waits until all the parts are there and haven't changed for a while. If they all have the same codecs etc, they're joined as-is, otherwise re-encoded.
+func joinMovieParts(folder string, file string, paths Paths, config Config) error {
+	joinedName := joinedMovieName(file)
+	parts, err := moviePartsFor(folder, joinedName)
+	if err != nil {
+		return err
+	}
+
+	// Wait until they've all arrived.
+	newest := time.Time{}
+	for _, part := range parts {
+		info, err := os.Stat(filepath.Join(folder, part.File))
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		if !canGetExclusiveAccessToFile(filepath.Join(folder, part.File)) {
+			return errors.New("Part " + part.File + " is still being copied")
+		}
+	}
+	if wait := partSettleTime - time.Since(newest); wait > 0 {
+		log.Printf("Waiting %s for any more parts of %s", wait.Round(time.Second), joinedName)
+		requestRescanAfter(wait + time.Second)
+		return nil
+	}
+	if len(parts) == 1 {
+		log.Println("Only found one part of", joinedName, "so processing it by itself")
+		return processMovie(folder, file, paths, config)
+	}
+	for i, part := range parts {
+		if part.Number != i+1 {
+			err := fmt.Errorf("Part %d of %s is missing", i+1, joinedName)
+			log.Println(err)
+			for _, part := range parts {
+				moveToFailed(filepath.Join(folder, part.File), paths)
+				writeFailedReason(filepath.Join(folder, part.File), paths, err.Error())
+			}
+			return err
+		}
+	}
+
+	// Join them, into a hidden file until it's done.
+	var inPaths []string
+	for _, part := range parts {
+		inPaths = append(inPaths, filepath.Join(folder, part.File))
+	}
+	sameFormat, err := areSameFormat(inPaths)
+	if err != nil {
+		return err
+	}
+	if !sameFormat {
+		joinedName = strings.TrimSuffix(joinedName, filepath.Ext(joinedName)) + ".mkv" // Anything can go in an mkv.
+	}
+	joinedPath := filepath.Join(folder, joinedName)
+	if exists(joinedPath) {
+		return errors.New("Not joining the parts, as " + joinedName + " already exists")
+	}
+	tempPath := filepath.Join(folder, "."+joinedName)
+	log.Printf("Joining %d parts into %s, re-encoding: %v", len(parts), joinedName, !sameFormat)
+	var joinErr error
+	if sameFormat {
+		joinErr = joinPartsAsIs(inPaths, tempPath)
+	} else {
+		joinErr = joinPartsReencoding(inPaths, tempPath, joinedName, config)
+	}
+	if joinErr != nil {
+		os.Remove(tempPath)
+		log.Println("Couldn't join the parts of", joinedName, "-", joinErr)
+		for _, inPath := range inPaths {
+			moveToFailed(inPath, paths)
+			writeFailedReason(inPath, paths, "Couldn't join the parts: "+joinErr.Error())
+		}
+		return joinErr
+	}
+	joinPartSidecars(inPaths, joinedPath, paths)
+	if err := os.Rename(tempPath, joinedPath); err != nil {
+		return err
+	}
+
+	// The joined file has everything now, so the parts can go, as with any source.
+	for _, inPath := range inPaths {
+		removeSource(inPath)
+	}
+	log.Println("Joined the parts, now processing", joinedName)
+	return processMovie(folder, joinedName, paths, config)
+}
+
+// Finds all the parts of a movie, in order.
+func moviePartsFor(folder string, joinedName string) ([]moviePart, error) {
+	files, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]moviePart, 0)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || !isValidExtension(filepath.Ext(file.Name())) {
+			continue
+		}
+		number, ok := moviePartNumber(file.Name())
+		if !ok || joinedMovieName(file.Name()) != joinedName {
+			continue
+		}
+		parts = append(parts, moviePart{File: file.Name(), Number: number})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// Whether the files can be joined without re-encoding: the same container, and the same video and audio formats.
+func areSameFormat(inPaths []string) (bool, error) {
+	var first string
+	for i, inPath := range inPaths {
+		result, err := probe(inPath)
+		if err != nil {
+			return false, fmt.Errorf("Couldn't probe %s - %v", filepath.Base(inPath), err)
+		}
+		format := strings.ToLower(filepath.Ext(inPath))
+		for _, stream := range result.videoStreams() {
+			format += fmt.Sprintf("|v:%s %dx%d %s %s %s", stream.Codec_name, stream.Width, stream.Height, stream.sampleAspectRatio(), stream.Pix_fmt, stream.frameRate())
+		}
+		for _, stream := range result.audioStreams() {
+			format += fmt.Sprintf("|a:%s %d %d", stream.Codec_name, stream.Channels, stream.sampleRate())
+		}
+		if i == 0 {
+			first = format
+		} else if format != first {
+			log.Printf("Parts differ: '%s' vs '%s'", first, format)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Joins the parts' subtitle sidecars, eg 'Movie.2001.CD1.en.srt' and 'Movie.2001.CD2.en.srt' into 'Movie.2001.en.srt', to go with the joined file.
+// Each part's subtitles are moved along by the length of the parts before it. Any that can't be joined, eg because a part is missing them, go to Failed.
+func joinPartSidecars(inPaths []string, joinedPath string, paths Paths) {
+	joinedBase := strings.TrimSuffix(joinedPath, filepath.Ext(joinedPath))
+	var durations []float64
+	for _, inPath := range inPaths {
+		result, err := probe(inPath)
+		if err != nil || result.Format.durationSeconds() <= 0 {
+			log.Println("Couldn't find the length of", filepath.Base(inPath), "so its subtitle sidecars can't be joined")
+			durations = nil
+			break
+		}
+		durations = append(durations, result.Format.durationSeconds())
+	}
+
+	// Group them by what comes after the part's name, eg '.en.srt'.
+	sidecarsBySuffix := make(map[string][]string)
+	var suffixes []string
+	for _, inPath := range inPaths {
+		partBase := strings.TrimSuffix(filepath.Base(inPath), filepath.Ext(inPath))
+		for _, sidecar := range sidecarSubtitlesFor(inPath) {
+			suffix := strings.TrimPrefix(filepath.Base(sidecar.Path), partBase)
+			if _, ok := sidecarsBySuffix[suffix]; !ok {
+				suffixes = append(suffixes, suffix)
+			}
+			sidecarsBySuffix[suffix] = append(sidecarsBySuffix[suffix], sidecar.Path)
+		}
+	}
+	for _, suffix := range suffixes {
+		sidecarPaths := sidecarsBySuffix[suffix]
+		joinedSidecarPath := joinedBase + suffix
+		var err error
+		if durations == nil {
+			err = errors.New("The parts' lengths are unknown")
+		} else if len(sidecarPaths) != len(inPaths) {
+			err = fmt.Errorf("Only %d of the %d parts have them", len(sidecarPaths), len(inPaths))
+		} else if exists(joinedSidecarPath) {
+			err = errors.New(filepath.Base(joinedSidecarPath) + " already exists")
+		} else {
+			err = joinWithConcatDemuxer(sidecarPaths, durations, nil, joinedSidecarPath)
+		}
+		if err != nil {
+			log.Printf("Couldn't join the '%s' subtitle sidecars, so moving them to Failed - %v", suffix, err)
+			for _, sidecarPath := range sidecarPaths {
+				os.Rename(sidecarPath, filepath.Join(paths.Failed, filepath.Base(sidecarPath)))
+			}
+			continue
+		}
+		log.Println("Joined the parts' subtitle sidecars into", filepath.Base(joinedSidecarPath))
+	}
+}
+
+// Joins with the concat demuxer, copying the streams.
+func joinPartsAsIs(inPaths []string, outPath string) error {
+	return joinWithConcatDemuxer(inPaths, nil, []string{"-map", "0", "-c", "copy"}, outPath)
+}
+
+// Runs the concat demuxer over the files. Each is moved along by the durations of the ones before it, which are read from the files unless given.
+func joinWithConcatDemuxer(inPaths []string, durations []float64, args []string, outPath string) error {
+	listPath := concatListPath(outPath)
+	if err := writeConcatList(listPath, inPaths, durations); err != nil {
+		return err
+	}
+	defer os.Remove(listPath)
+	allArgs := append([]string{"-f", "concat", "-safe", "0", "-i", listPath}, args...)
+	if _, err := ffmpeg(append(allArgs, "-y", outPath)); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+// Next to the output, hidden, so it's not mistaken for a sidecar.
+func concatListPath(outPath string) string {
+	return filepath.Join(filepath.Dir(outPath), "."+strings.TrimPrefix(filepath.Base(outPath), ".")+".txt")
+}
+
+func writeConcatList(listPath string, inPaths []string, durations []float64) error {
+	list := ""
+	for i, inPath := range inPaths {
+		list += "file '" + strings.ReplaceAll(inPath, "'", `'\''`) + "'\n"
+		if durations != nil {
+			list += fmt.Sprintf("duration %f\n", durations[i])
+		}
+	}
+	return os.WriteFile(listPath, []byte(list), os.ModePerm)
+}
+
+// Joins with the concat filter, which can join different formats, scaling each part to the display size of the first.
+// All the audio streams are kept, with their channel layouts, as the first part has them, and silence for parts without them.
+// Subtitles can't go through the filter, so they're joined by the concat demuxer, as long as every part has the same ones.
+// The audio is lossless, as it's encoded again when it's transcoded. The encoder settings are as per the joined name, eg a 'preset-X' in it.
+func joinPartsReencoding(inPaths []string, outPath string, joinedName string, config Config) error {
+	var probes []*ProbeResult
+	audioCount := 0
+	for _, inPath := range inPaths {
+		result, err := probe(inPath)
+		if err != nil {
+			return err
+		}
+		probes = append(probes, result)
+		audioCount = int(math.Max(float64(audioCount), float64(len(result.audioStreams()))))
+	}
+	videoStreams := probes[0].videoStreams()
+	if len(videoStreams) == 0 {
+		return errors.New("The first part has no video")
+	}
+	// Square pixels at the first part's display size, eg 1024x576 for a 16:9 PAL DVD, so parts with different pixel shapes line up.
+	height := videoStreams[0].Height
+	width := videoStreams[0].Width
+	if aspect := videoStreams[0].displayAspectRatio(); aspect.isValid() {
+		width = int(math.Round(float64(height)*aspect.float()/2)) * 2
+	}
+
+	// Each audio output's format, as the first part that has it.
+	sampleRates := make([]int, audioCount)
+	channelLayouts := make([]string, audioCount)
+	audioSources := make([]int, audioCount)
+	for a := 0; a < audioCount; a++ {
+		for i, result := range probes {
+			if streams := result.audioStreams(); a < len(streams) {
+				sampleRates[a], channelLayouts[a] = audioFormatOf(streams[a])
+				audioSources[a] = i
+				break
+			}
+		}
+	}
+
+	var args []string
+	filter := ""
+	for i, inPath := range inPaths {
+		args = append(args, "-i", inPath)
+		filter += fmt.Sprintf("[%d:v:0]scale=iw*sar:ih,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[v%d];", i, width, height, width, height, i)
+		for a := 0; a < audioCount; a++ {
+			if a < len(probes[i].audioStreams()) {
+				filter += fmt.Sprintf("[%d:a:%d]aformat=sample_rates=%d:channel_layouts=%s[a%d_%d];", i, a, sampleRates[a], channelLayouts[a], i, a)
+			} else {
+				filter += fmt.Sprintf("anullsrc=sample_rate=%d:channel_layout=%s,atrim=duration=%f[a%d_%d];", sampleRates[a], channelLayouts[a], probes[i].Format.durationSeconds(), i, a)
+			}
+		}
+	}
+	for i := range inPaths {
+		filter += fmt.Sprintf("[v%d]", i)
+		for a := 0; a < audioCount; a++ {
+			filter += fmt.Sprintf("[a%d_%d]", i, a)
+		}
+	}
+	filter += fmt.Sprintf("concat=n=%d:v=1:a=%d[v]", len(inPaths), audioCount)
+	for a := 0; a < audioCount; a++ {
+		filter += fmt.Sprintf("[a%d]", a)
+	}
+
+	// The subtitles, via the concat demuxer as an extra input.
+	hasSubtitles := haveSameSubtitles(probes)
+	if hasSubtitles {
+		listPath := concatListPath(outPath)
+		if err := writeConcatList(listPath, inPaths, nil); err != nil {
+			return err
+		}
+		defer os.Remove(listPath)
+		args = append(args, "-f", "concat", "-safe", "0", "-i", listPath)
+	}
+
+	encoder, err := encoderSettingsFor(joinedName, config)
+	if err != nil {
+		return err
+	}
+	args = append(args, "-filter_complex", filter, "-map", "[v]")
+	for a := 0; a < audioCount; a++ {
+		args = append(args, "-map", fmt.Sprintf("[a%d]", a), fmt.Sprintf("-map_metadata:s:a:%d", a), fmt.Sprintf("%d:s:a:%d", audioSources[a], a))
+	}
+	if hasSubtitles {
+		args = append(args, "-map", fmt.Sprintf("%d:s?", len(inPaths)), "-c:s", "copy")
+	}
+	args = append(args, encoder.videoArgs()...)
+	args = append(args, encoder.threadsArgs()...)
+	args = append(args, "-c:a", "flac", "-y", outPath)
+	_, err = ffmpeg(args)
+	return err
+}
+
+// An audio stream's sample rate and channel layout, eg 48000 and '5.1(side)', guessing if ffprobe doesn't say.
+func audioFormatOf(stream ProbeStream) (int, string) {
+	sampleRate := stream.sampleRate()
+	if sampleRate == 0 {
+		sampleRate = 48000
+	}
+	channelLayout := stream.Channel_layout
+	if channelLayout == "" && stream.Channels == 1 {
+		channelLayout = "mono"
+	} else if channelLayout == "" {
+		channelLayout = "stereo"
+	}
+	return sampleRate, channelLayout
+}
+
+// Whether all the parts have the same subtitle streams, so they can be joined. Logs if they'll be left out.
+func haveSameSubtitles(probes []*ProbeResult) bool {
+	var first string
+	for i, result := range probes {
+		format := ""
+		for _, stream := range result.subtitleStreams() {
+			format += stream.Codec_name + " " + stream.Tags.Language + "|"
+		}
+		if i == 0 {
+			first = format
+		} else if format != first {
+			log.Printf("The parts have different subtitles, so they're left out: '%s' vs '%s'", first, format)
+			return false
+		}
+	}
+	return first != ""
+}
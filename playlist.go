@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The master playlist, which is what players open. It's only a few lines, so the framerate etc can be set, and subtitles listed.
+type masterPlaylist struct {
+	FrameRate  float64
+	Codecs     string // Eg 'avc1.640028,mp4a.40.2', or "" if unknown.
+	Resolution string // Eg '1920x1080', or "" if unknown.
+	Subtitles  []subtitleRendition
+	Audio      []audioRendition // Empty if there's just the audio in the video's segments.
+	IFrames    *iFramesStream   // Nil if there's no I-frame playlist.
+}
+
+// The I-frame only playlist, as listed in the master playlist.
+type iFramesStream struct {
+	Bandwidth        int    // The peak, as HLS requires.
+	AverageBandwidth int    // 0 if unknown.
+	Codec            string // Just the video codec, or "" if unknown.
+}
+
+func (i iFramesStream) streamInfTag(resolution string) string {
+	attributes := fmt.Sprintf("BANDWIDTH=%d", i.Bandwidth)
+	if i.AverageBandwidth > 0 {
+		attributes += fmt.Sprintf(",AVERAGE-BANDWIDTH=%d", i.AverageBandwidth)
+	}
+	if i.Codec != "" {
+		attributes += fmt.Sprintf(",CODECS=%q", i.Codec)
+	}
+	if resolution != "" {
+		attributes += ",RESOLUTION=" + resolution
+	}
+	return fmt.Sprintf("#EXT-X-I-FRAME-STREAM-INF:%s,URI=%q", attributes, iFramesFilename)
+}
+
+func (m masterPlaylist) write(outFolder string) error {
+	xStreamInfSuffix := ""
+	headerSubsLines := ""
+	if m.Codecs != "" {
+		xStreamInfSuffix += fmt.Sprintf(",CODECS=%q", m.Codecs)
+	}
+	if m.Resolution != "" {
+		xStreamInfSuffix += ",RESOLUTION=" + m.Resolution
+	}
+	if len(m.Audio) > 0 {
+		xStreamInfSuffix += ",AUDIO=\"audio\""
+		for _, rendition := range m.Audio {
+			headerSubsLines += rendition.mediaTag() + "\n"
+		}
+	}
+	if len(m.Subtitles) > 0 {
+		xStreamInfSuffix += ",SUBTITLES=\"subs\""
+		for _, rendition := range m.Subtitles {
+			headerSubsLines += rendition.mediaTag() + "\n"
+		}
+	}
+	iFramesLine := ""
+	if m.IFrames != nil {
+		iFramesLine = m.IFrames.streamInfTag(m.Resolution) + "\n"
+	}
+	content := fmt.Sprintf("#EXTM3U\n%v#EXT-X-STREAM-INF:BANDWIDTH=1000000,FRAME-RATE=%f%v\n%s\n%v#EXT-X-ENDLIST", headerSubsLines, m.FrameRate, xStreamInfSuffix, hlsSegmentsFilename, iFramesLine)
+	return os.WriteFile(filepath.Join(outFolder, hlsFilename), []byte(content), os.ModePerm)
+}
+
+// One segment in a media playlist.
+type mediaSegment struct {
+	Duration      float64 // As per its EXTINF, in seconds.
+	URI           string  // Relative to the playlist, eg 'seg0.ts'.
+	Discontinuity bool    // Whether there's an EXT-X-DISCONTINUITY before it, eg where a transcode was resumed.
+}
+
+// The bits of a media playlist (eg seg.m3u8) we care about.
+type mediaPlaylist struct {
+	TargetDuration int
+	Segments       []mediaSegment
+	Ended          bool // Has an EXT-X-ENDLIST, meaning it's complete.
+}
+
+// Reads a media playlist, eg the seg.m3u8 ffmpeg makes.
+func readMediaPlaylist(path string) (mediaPlaylist, error) {
+	var playlist mediaPlaylist
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return playlist, err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "#EXTM3U" {
+		return playlist, errors.New("Not a playlist: " + path)
+	}
+	var duration *float64
+	discontinuity := false
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			playlist.TargetDuration, _ = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"))
+		} else if strings.HasPrefix(line, "#EXTINF:") {
+			value := strings.Split(strings.TrimPrefix(line, "#EXTINF:"), ",")[0]
+			d, parseErr := strconv.ParseFloat(value, 64)
+			if parseErr != nil {
+				return playlist, fmt.Errorf("Bad EXTINF in %s - %v", path, parseErr)
+			}
+			duration = &d
+		} else if line == "#EXT-X-DISCONTINUITY" {
+			discontinuity = true
+		} else if line == "#EXT-X-ENDLIST" {
+			playlist.Ended = true
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			if duration == nil {
+				return playlist, errors.New("Segment without an EXTINF in " + path)
+			}
+			playlist.Segments = append(playlist.Segments, mediaSegment{Duration: *duration, URI: line, Discontinuity: discontinuity})
+			duration = nil
+			discontinuity = false
+		}
+	}
+	return playlist, nil
+}
+
+// Writes a VOD media playlist for the given segments.
+func writeMediaPlaylist(path string, segments []mediaSegment) error {
+	targetDuration := 1
+	for _, segment := range segments {
+		if d := int(math.Ceil(segment.Duration)); d > targetDuration {
+			targetDuration = d
+		}
+	}
+	content := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n", targetDuration)
+	for _, segment := range segments {
+		if segment.Discontinuity {
+			content += "#EXT-X-DISCONTINUITY\n"
+		}
+		content += fmt.Sprintf("#EXTINF:%f,\n%s\n", segment.Duration, segment.URI)
+	}
+	content += "#EXT-X-ENDLIST\n"
+	return os.WriteFile(path, []byte(content), os.ModePerm)
+}
+
+// Probes the output, to find out what was actually produced.
+// MPEG-TS segments can be probed by themselves, but fMP4 ones need their init segment, so the playlist is probed instead.
+func probeSegments(outFolder string, playlist mediaPlaylist) (*ProbeResult, error) {
+	if len(playlist.Segments) == 0 {
+		return nil, errors.New("No segments")
+	}
+	first := playlist.Segments[0].URI
+	if strings.HasSuffix(first, ".ts") {
+		return probe(filepath.Join(outFolder, first))
+	}
+	return probe(filepath.Join(outFolder, hlsSegmentsFilename))
+}
+
+// Finds the MPEG-TS timestamp (in 90kHz units) that the segments start at, which is what WebVTT's X-TIMESTAMP-MAP needs.
+// ffmpeg shifts the source's start to zero then adds its mux delay, so this is found by probing the segments.
+func mpegtsStartOf(segmentsProbe *ProbeResult) (int64, error) {
+	startTime, err := strconv.ParseFloat(segmentsProbe.Format.Start_time, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Round(startTime * 90000)), nil
+}
@@ -8,8 +8,9 @@ import (
 // For JSON to parse, _ needs to be as-is, and they need to start caps in the structs.
 
 type ProbeResult struct {
-	Streams []ProbeStream
-	Format  ProbeFormat
+	Streams  []ProbeStream
+	Format   ProbeFormat
+	Chapters []ProbeChapter
 }
 
 type ProbeStream struct {
@@ -57,6 +58,9 @@ type ProbeStream struct {
 	Coded_height         int    // 0,
 	Coded_width          int    // 0,
 	Color_range          string // "tv",
+	Color_space          string // "bt709", "bt2020nc",
+	Color_transfer       string // "bt709", "smpte2084" (PQ, HDR10), "arib-std-b67" (HLG),
+	Color_primaries      string // "bt709", "bt2020",
 	Display_aspect_ratio string // "16:9",
 	Dmix_mode            string // ": "-1",
 	Duration             string // "2.033911",
@@ -83,6 +87,33 @@ type ProbeStream struct {
 	Time_base            string // "1/90000",
 	Timecode             string // "00:59:58:00",
 	Width                int    // 720,
+	Tags                 ProbeTags
+	Disposition          ProbeDisposition
+	Side_data_list       []ProbeSideData
+}
+
+// Extra per-stream data, eg HDR mastering metadata or Dolby Vision configuration.
+type ProbeSideData struct {
+	Side_data_type string // "Mastering display metadata", "Content light level metadata", "DOVI configuration record",
+}
+
+// The tags ffprobe reports for a stream, only the ones we care about.
+type ProbeTags struct {
+	Language string // "eng", "fre", "und",
+	Title    string // "Director's Commentary",
+	Duration string // "00:42:10.123000000", only in mkv, which doesn't have the stream's duration otherwise.
+}
+
+// The disposition flags ffprobe reports for a stream, 1 means set.
+type ProbeDisposition struct {
+	Default          int // 1,
+	Dub              int // 0,
+	Original         int // 0,
+	Comment          int // 0, Set for commentary tracks.
+	Forced           int // 0,
+	Hearing_impaired int // 0,
+	Visual_impaired  int // 0,
+	Attached_pic     int // 0, Set for cover art in mkv/mp4.
 }
 
 type ProbeFormat struct {
@@ -97,10 +128,20 @@ type ProbeFormat struct {
 	Probe_score      int    //": 52
 }
 
+type ProbeChapter struct {
+	Id         int64  // 0,
+	Time_base  string // "1/1000000000",
+	Start      int64  // 0,
+	Start_time string // "0.000000",
+	End        int64  // 300300000000,
+	End_time   string // "300.300000",
+	Tags       ProbeTags
+}
+
 // Probes a media file
 func probe(path string) (*ProbeResult, error) {
 	// Run
-	out, runErr := exec.Command("ffprobe", "-v", "quiet", "-of", "json", "-show_format", "-show_streams", path).Output()
+	out, runErr := exec.Command("ffprobe", "-v", "quiet", "-of", "json", "-show_format", "-show_streams", "-show_chapters", path).Output()
 	if runErr != nil {
 		return nil, runErr
 	}
@@ -131,11 +172,12 @@ func (r *ProbeResult) videoStreams() []ProbeStream {
 	return streams
 }
 
-func (r *ProbeResult) hasSubtitles() bool {
+func (r *ProbeResult) subtitleStreams() []ProbeStream {
+	streams := make([]ProbeStream, 0)
 	for _, stream := range r.Streams {
 		if stream.Codec_type == "subtitle" {
-			return true
+			streams = append(streams, stream)
 		}
 	}
-	return false
+	return streams
 }
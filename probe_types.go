@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Typed views of ffprobe's output. The structs in probe.go keep ffprobe's strings as-is, and these parse them.
+
+// Eg a frame rate of 24000/1001, or an aspect ratio of 16:9. ffprobe says '0/0' when it doesn't know.
+type Rational struct {
+	Num int64
+	Den int64
+}
+
+// Parses eg '24000/1001', '16:9' or '25'. Returns a zero rational if it can't.
+func parseRational(s string) Rational {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == ':' })
+	if len(parts) == 1 {
+		num, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return Rational{}
+		}
+		return Rational{Num: num, Den: 1}
+	}
+	if len(parts) != 2 {
+		return Rational{}
+	}
+	num, numErr := strconv.ParseInt(parts[0], 10, 64)
+	den, denErr := strconv.ParseInt(parts[1], 10, 64)
+	if numErr != nil || denErr != nil {
+		return Rational{}
+	}
+	return Rational{Num: num, Den: den}
+}
+
+// Returns false for eg '0/0', which ffprobe uses for unknown.
+func (r Rational) isValid() bool {
+	return r.Num > 0 && r.Den > 0
+}
+
+// Eg 23.976, or 0 if it's not valid.
+func (r Rational) float() float64 {
+	if !r.isValid() {
+		return 0
+	}
+	return float64(r.Num) / float64(r.Den)
+}
+
+func (r Rational) String() string {
+	return strconv.FormatInt(r.Num, 10) + "/" + strconv.FormatInt(r.Den, 10)
+}
+
+// Parses one of ffprobe's number strings, eg '2.057911'. ffprobe says 'N/A' or leaves it out when it doesn't know.
+func parseProbeFloat(s string) (float64, bool) {
+	value, err := strconv.ParseFloat(s, 64)
+	return value, err == nil
+}
+
+// Transfer characteristics that mean HDR: PQ (HDR10, Dolby Vision) and HLG.
+const hdrColorTransfers = "smpte2084 arib-std-b67"
+
+// The frame rate, eg 23.976. Uses the average, falling back to the container's guess if that's unknown. 0 if both are.
+func (s ProbeStream) frameRate() Rational {
+	if rate := parseRational(s.Avg_frame_rate); rate.isValid() {
+		return rate
+	}
+	return parseRational(s.R_frame_rate)
+}
+
+// Eg 64:45 for a 16:9 PAL DVD. Square pixels if unknown.
+func (s ProbeStream) sampleAspectRatio() Rational {
+	if ratio := parseRational(s.Sample_aspect_ratio); ratio.isValid() {
+		return ratio
+	}
+	return Rational{Num: 1, Den: 1}
+}
+
+// Eg 16:9. Works it out from the size and SAR if ffprobe doesn't say.
+func (s ProbeStream) displayAspectRatio() Rational {
+	if ratio := parseRational(s.Display_aspect_ratio); ratio.isValid() {
+		return ratio
+	}
+	sar := s.sampleAspectRatio()
+	return Rational{Num: int64(s.Width) * sar.Num, Den: int64(s.Height) * sar.Den}
+}
+
+// The stream's duration in seconds, or 0 if unknown.
+// mkv only has it in a tag, eg '00:42:10.123000000'.
+func (s ProbeStream) durationSeconds() float64 {
+	if duration, ok := parseProbeFloat(s.Duration); ok {
+		return duration
+	}
+	parts := strings.Split(s.Tags.Duration, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	hours, _ := strconv.ParseFloat(parts[0], 64)
+	minutes, _ := strconv.ParseFloat(parts[1], 64)
+	seconds, _ := strconv.ParseFloat(parts[2], 64)
+	return hours*3600 + minutes*60 + seconds
+}
+
+// In bits per second, or 0 if unknown.
+func (s ProbeStream) bitRate() int64 {
+	rate, _ := strconv.ParseInt(s.Bit_rate, 10, 64)
+	return rate
+}
+
+// Eg 48000, or 0 if unknown or not audio.
+func (s ProbeStream) sampleRate() int {
+	rate, _ := strconv.Atoi(s.Sample_rate)
+	return rate
+}
+
+// Whether it's HDR, as per its transfer characteristics, or Dolby Vision side data.
+func (s ProbeStream) isHDR() bool {
+	return isCodecInList(s.Color_transfer, hdrColorTransfers) || s.isDolbyVision()
+}
+
+func (s ProbeStream) isDolbyVision() bool {
+	for _, sideData := range s.Side_data_list {
+		if sideData.Side_data_type == "DOVI configuration record" {
+			return true
+		}
+	}
+	return false
+}
+
+// In seconds, or 0 if unknown.
+func (f ProbeFormat) durationSeconds() float64 {
+	duration, _ := parseProbeFloat(f.Duration)
+	return duration
+}
+
+// MPEG-PS, eg a VOB or DVD titles joined together, doesn't record its duration, so ffprobe guesses it from the bitrate, which can be well out.
+func (f ProbeFormat) durationIsEstimated() bool {
+	return f.Format_name == "mpeg" || f.Format_name == "vob"
+}
+
+// In seconds, or 0 if unknown.
+func (f ProbeFormat) startSeconds() float64 {
+	start, _ := parseProbeFloat(f.Start_time)
+	return start
+}
+
+// In bytes, or 0 if unknown.
+func (f ProbeFormat) sizeBytes() int64 {
+	size, _ := strconv.ParseInt(f.Size, 10, 64)
+	return size
+}
+
+// The chapter's start and end in seconds, and whether they're known and the right way around.
+func (c ProbeChapter) times() (float64, float64, bool) {
+	start, startOk := parseProbeFloat(c.Start_time)
+	end, endOk := parseProbeFloat(c.End_time)
+	return start, end, startOk && endOk && end > start
+}
+
+// The audio stream flagged as default, or the first if none are. Nil if there's no audio.
+func (r *ProbeResult) defaultAudio() *ProbeStream {
+	streams := r.audioStreams()
+	if len(streams) == 0 {
+		return nil
+	}
+	for i, stream := range streams {
+		if stream.Disposition.Default == 1 {
+			return &streams[i]
+		}
+	}
+	return &streams[0]
+}
+
+// The subtitles that can be converted to WebVTT, as opposed to bitmap ones.
+func (r *ProbeResult) textSubtitles() []ProbeStream {
+	streams := make([]ProbeStream, 0)
+	for _, stream := range r.subtitleStreams() {
+		if isTextSubtitle(stream) {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	statusFilename      = "status.json"    // In the staging folder, lists the transcodes in progress.
+	statusWriteInterval = 10 * time.Second // So a slow disk isn't hammered with every line ffmpeg outputs.
+)
+
+// How a transcode is going, as written to the status file.
+type TranscodeStatus struct {
+	Name       string             // The source file.
+	Percent    float64            // 0-100.
+	Speed      float64            // Eg 0.5 means it's transcoding at half real-time.
+	ETASeconds int                // How long until it's done, or 0 if unknown.
+	ETA        string             // Eg '3h25m0s', or "" if unknown.
+	Estimate   *TranscodeEstimate // From the benchmark before it started, or nil if there wasn't one.
+	Updated    string             // When this was last updated, RFC3339.
+}
+
+// Keeps track of one transcode's progress, by reading ffmpeg's output.
+type transcodeProgress struct {
+	statusPath string
+	duration   float64 // Of the source, in seconds, as per the probe.
+	status     TranscodeStatus
+	lastWrite  time.Time
+}
+
+var (
+	transcodeStatusesMutex sync.Mutex
+	transcodeStatuses      = make(map[string]TranscodeStatus) // Keyed by name. Protected by the mutex above.
+	ffmpegTimeRegex        = regexp.MustCompile(`time=\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+	ffmpegSpeedRegex       = regexp.MustCompile(`speed=\s*(\d+(?:\.\d+)?)x`)
+)
+
+// Starts tracking a transcode, adding it to the status file.
+func startTranscodeProgress(paths Paths, name string, duration float64) *transcodeProgress {
+	p := &transcodeProgress{
+		statusPath: filepath.Join(paths.Staging, statusFilename),
+		duration:   duration,
+		status:     TranscodeStatus{Name: name},
+	}
+	p.write()
+	return p
+}
+
+// Reads a line of ffmpeg's output, eg 'frame= 1234 fps=12 q=28.0 size=1024kB time=00:01:23.45 bitrate=... speed=0.52x'.
+// Safe to call from several goroutines, eg for stdout and stderr.
+func (p *transcodeProgress) onLine(line string) {
+	if p == nil {
+		return
+	}
+	done, ok := ffmpegTimeSeconds(line)
+	if !ok || p.duration <= 0 {
+		return
+	}
+
+	transcodeStatusesMutex.Lock()
+	p.status.Percent = math.Min(100, math.Round(done/p.duration*1000)/10)
+	if speedMatches := ffmpegSpeedRegex.FindStringSubmatch(line); len(speedMatches) >= 2 {
+		p.status.Speed, _ = strconv.ParseFloat(speedMatches[1], 64)
+	}
+	if p.status.Speed > 0 {
+		eta := time.Duration(math.Max(0, p.duration-done)/p.status.Speed) * time.Second
+		p.status.ETASeconds = int(eta.Seconds())
+		p.status.ETA = eta.String()
+	}
+	shouldWrite := time.Since(p.lastWrite) >= statusWriteInterval
+	status := p.status // A copy, as a worker's heartbeat can replace it.
+	transcodeStatusesMutex.Unlock()
+
+	if shouldWrite {
+		log.Printf("Progress: %.1f%% at %.2fx, ETA %s", status.Percent, status.Speed, status.ETA)
+		p.write()
+	}
+}
+
+// The time ffmpeg says it's got to in a line of its output, in seconds, and whether there was one.
+func ffmpegTimeSeconds(line string) (float64, bool) {
+	timeMatches := ffmpegTimeRegex.FindStringSubmatch(line)
+	if len(timeMatches) < 4 {
+		return 0, false
+	}
+	hours, _ := strconv.ParseFloat(timeMatches[1], 64)
+	minutes, _ := strconv.ParseFloat(timeMatches[2], 64)
+	seconds, _ := strconv.ParseFloat(timeMatches[3], 64)
+	return hours*3600 + minutes*60 + seconds, true
+}
+
+// How much ffmpeg says it decoded, as per the last time in its output, in seconds, or 0 if it didn't say.
+// The output's progress lines aren't necessarily separated, as they end in carriage returns, which are split off.
+func ffmpegDecodedSeconds(output string) float64 {
+	times := ffmpegTimeRegex.FindAllString(output, -1)
+	if len(times) == 0 {
+		return 0
+	}
+	seconds, _ := ffmpegTimeSeconds(times[len(times)-1])
+	return seconds
+}
+
+// Sets the progress as reported from elsewhere, eg a worker, keeping the name.
+func (p *transcodeProgress) update(status TranscodeStatus) {
+	if p == nil {
+		return
+	}
+	transcodeStatusesMutex.Lock()
+	status.Name = p.status.Name
+	p.status = status
+	transcodeStatusesMutex.Unlock()
+	p.write()
+}
+
+// Records the estimate from before it started, so it can be compared with how it's actually going.
+func (p *transcodeProgress) setEstimate(estimate *TranscodeEstimate) {
+	if p == nil || estimate == nil {
+		return
+	}
+	transcodeStatusesMutex.Lock()
+	p.status.Estimate = estimate
+	transcodeStatusesMutex.Unlock()
+	p.write()
+}
+
+// Removes the transcode from the status file, whether it succeeded or not.
+func (p *transcodeProgress) finish() {
+	if p == nil {
+		return
+	}
+	transcodeStatusesMutex.Lock()
+	delete(transcodeStatuses, p.status.Name)
+	transcodeStatusesMutex.Unlock()
+	p.writeAll()
+}
+
+func (p *transcodeProgress) write() {
+	transcodeStatusesMutex.Lock()
+	p.lastWrite = time.Now()
+	p.status.Updated = p.lastWrite.Format(time.RFC3339)
+	transcodeStatuses[p.status.Name] = p.status
+	transcodeStatusesMutex.Unlock()
+	p.writeAll()
+}
+
+// Writes every transcode's status to the status file.
+// This holds the mutex throughout, as stdout and stderr are read concurrently, and writes to a temporary file then renames it,
+// so the metadata never reads a half-written one.
+func (p *transcodeProgress) writeAll() {
+	transcodeStatusesMutex.Lock()
+	defer transcodeStatusesMutex.Unlock()
+	statuses := make([]TranscodeStatus, 0)
+	for _, status := range transcodeStatuses {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	data, _ := json.MarshalIndent(statuses, "", "    ")
+	tempPath := p.statusPath + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, os.ModePerm); err != nil {
+		log.Println("Couldn't write the status file:", err)
+		return
+	}
+	if err := os.Rename(tempPath, p.statusPath); err != nil {
+		log.Println("Couldn't replace the status file:", err)
+	}
+}
+
+// Reads the status file, for the metadata. Returns an empty list if there's nothing in progress.
+func readTranscodeStatuses(paths Paths) []TranscodeStatus {
+	statuses := make([]TranscodeStatus, 0)
+	readAndUnmarshal(paths.Staging, statusFilename, &statuses)
+	return statuses
+}
+
+// Eg 'Big Buck Bunny.vob: 45.2% at 0.52x, about 3h25m0s to go'.
+func (s TranscodeStatus) String() string {
+	description := fmt.Sprintf("%s: %.1f%%", s.Name, s.Percent)
+	if s.Speed > 0 {
+		description += fmt.Sprintf(" at %.2fx, about %s to go", s.Speed, s.ETA)
+	}
+	return description
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	resumePlaylistFilename    = "resume.m3u8" // The segments made after resuming, before they're stitched onto seg.m3u8.
+	resumeManifestFilename    = "resume.json" // What made the partial segments, so only the same transcode carries on from them.
+	resumeTimestampTolerance  = 0.25          // Seconds the resumed segments' timestamps can be off by before a discontinuity is needed.
+	resumeKeyframeTolerance   = 0.01          // Seconds a segment boundary can be off a keyframe by, as the playlist's durations are rounded.
+	resumeKeyframeSearch      = 120           // Seconds before the end of the kept segments to look for a keyframe to cut at.
+	resumeSegmentFilenameForm = "seg%d.ts"    // As ffmpeg names them for seg.m3u8, so resumed segments carry on the numbering.
+)
+
+// Written next to the segments when a transcode starts. Staging is keyed by title, so without this a different rip
+// of the same film, or the same file renamed with different flags, would have the old segments stitched in.
+type resumeManifest struct {
+	Source  string   // The source's path, which includes any flags, eg 'deinterlace'.
+	Size    int64    // The source's size and modification time, in case it's been replaced.
+	ModTime string   // RFC3339, to the nanosecond.
+	Args    []string // ffmpeg's args as first tried, ie before any recoveries or re-encoding.
+
+	// What the retries had to add, so resuming carries on the same way.
+	Recoveries []string // Names, in the order they were applied.
+	Reencoding bool     // Whether copying failed so everything's re-encoded.
+}
+
+func newResumeManifest(inPath string, args []string) (resumeManifest, error) {
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return resumeManifest{}, err
+	}
+	return resumeManifest{Source: inPath, Size: info.Size(), ModTime: info.ModTime().Format(time.RFC3339Nano), Args: args}, nil
+}
+
+func writeResumeManifest(outFolder string, inPath string, args []string, recoveries []*ffmpegRecovery, reencoding bool) error {
+	manifest, err := newResumeManifest(inPath, args)
+	if err != nil {
+		return err
+	}
+	for _, recovery := range recoveries {
+		manifest.Recoveries = append(manifest.Recoveries, recovery.Name)
+	}
+	manifest.Reencoding = reencoding
+	data, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outFolder, resumeManifestFilename), data, os.ModePerm)
+}
+
+// Whether the source is still there, unchanged.
+func (m resumeManifest) sourceUnchanged() bool {
+	current, err := newResumeManifest(m.Source, nil)
+	return err == nil && current.Size == m.Size && current.ModTime == m.ModTime
+}
+
+// Whether it's the same transcode: the same source, unchanged, with the same args before any recoveries.
+func (m resumeManifest) matches(inPath string, args []string) bool {
+	return m.Source == inPath && m.sourceUnchanged() && strings.Join(m.Args, "\x00") == strings.Join(args, "\x00")
+}
+
+// The segments from an interrupted transcode that are kept, and where to carry on from.
+type hlsResume struct {
+	Segments   []mediaSegment
+	Start      float64  // Seconds, the end of the kept segments.
+	Recoveries []string // As per the manifest, to be applied again.
+	Reencoding bool
+}
+
+// Looks for a partial seg.m3u8 from an interrupted transcode (eg a power cut) and keeps the segments it lists.
+// ffmpeg only lists a segment once it's finished writing it, so those are complete. Returns nil if there's nothing to resume.
+// It's only resumed if it was made from the same source with the same args, as per its manifest.
+// args are as first tried; any recoveries the interrupted transcode needed are in the result, to be applied again.
+func resumableSegments(outFolder string, inPath string, args []string) *hlsResume {
+	playlist, err := readMediaPlaylist(filepath.Join(outFolder, hlsSegmentsFilename))
+	if err != nil || playlist.Ended {
+		return nil // No partial transcode, or it finished, in which case it's safer to redo it than to trust whatever happened after.
+	}
+	var manifest resumeManifest
+	if err := readAndUnmarshal(outFolder, resumeManifestFilename, &manifest); err != nil || !manifest.matches(inPath, args) {
+		log.Println("Not resuming the partial transcode in staging, as it was made from a different source or with different settings")
+		return nil
+	}
+	resume := hlsResume{Recoveries: manifest.Recoveries, Reencoding: manifest.Reencoding}
+	for _, segment := range playlist.Segments {
+		if !isNonEmptyFile(filepath.Join(outFolder, segment.URI)) {
+			break
+		}
+		resume.Segments = append(resume.Segments, segment)
+		resume.Start += segment.Duration
+	}
+	if len(resume.Segments) == 0 {
+		return nil
+	}
+	return &resume
+}
+
+// When copying video, seeking can only land on a keyframe, so the kept segments have to end on one, or content would be repeated.
+// Drops kept segments from the end until that's so. Returns false if there's no such point.
+func (r *hlsResume) cutAtKeyframe(inPath string, videoStreamIndex int) bool {
+	sourceProbe, err := probe(inPath)
+	if err != nil {
+		log.Println("Couldn't probe the source to find a keyframe to resume from:", err)
+		return false
+	}
+	sourceStart := sourceProbe.Format.startSeconds()
+	from := sourceStart + math.Max(0, r.Start-resumeKeyframeSearch)
+	to := sourceStart + r.Start + 1
+	out, err := exec.Command("ffprobe", "-v", "quiet", "-select_streams", strconv.Itoa(videoStreamIndex), "-read_intervals", fmt.Sprintf("%f%%%f", from, to),
+		"-show_entries", "packet=pts_time,flags", "-of", "csv=p=0", inPath).Output()
+	if err != nil {
+		log.Println("Couldn't find the source's keyframes to resume from:", err)
+		return false
+	}
+	var keyframes []float64
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.Contains(fields[1], "K") {
+			continue
+		}
+		if pts, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			keyframes = append(keyframes, pts-sourceStart)
+		}
+	}
+
+	// Try each segment boundary, latest first.
+	for count := len(r.Segments); count > 0; count-- {
+		end := 0.0
+		for _, segment := range r.Segments[:count] {
+			end += segment.Duration
+		}
+		for _, keyframe := range keyframes {
+			if math.Abs(keyframe-end) <= resumeKeyframeTolerance {
+				if count < len(r.Segments) {
+					log.Printf("Resuming from segment %d rather than %d, as that's where there's a keyframe", count, len(r.Segments))
+				}
+				r.Segments = r.Segments[:count]
+				r.Start = end
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// How much of the source is left to transcode, which is all of it if there's nothing to resume.
+func remainingDuration(duration float64, resume *hlsResume) float64 {
+	if resume == nil {
+		return duration
+	}
+	return math.Max(0, duration-resume.Start)
+}
+
+// Seeks to where the kept segments end.
+func (r hlsResume) inputArgs() []string {
+	return []string{"-ss", fmt.Sprintf("%f", r.Start)}
+}
+
+// Keeps the timestamps as they would have been without the seek, and carries on the segment numbering.
+// The new segments are listed in their own playlist, to be stitched on afterwards.
+func (r hlsResume) outputArgs(outFolder string) []string {
+	return []string{
+		"-copyts", "-start_at_zero",
+		"-start_number", strconv.Itoa(len(r.Segments)),
+		"-hls_segment_filename", filepath.Join(outFolder, resumeSegmentFilenameForm),
+	}
+}
+
+// Joins the kept and new segments into seg.m3u8. There's only a discontinuity if the new segments' timestamps don't carry on from the old ones,
+// eg when copying video, which can only seek to a keyframe.
+func (r hlsResume) stitch(outFolder string) error {
+	resumedPath := filepath.Join(outFolder, resumePlaylistFilename)
+	resumed, err := readMediaPlaylist(resumedPath)
+	if err != nil {
+		return fmt.Errorf("Couldn't read the resumed segments - %v", err)
+	}
+	if len(resumed.Segments) == 0 {
+		return errors.New("Resuming made no segments")
+	}
+
+	discontinuity, err := r.needsDiscontinuity(outFolder, resumed.Segments[0])
+	if err != nil {
+		log.Println("Couldn't compare the resumed segments' timestamps, so adding a discontinuity to be safe:", err)
+		discontinuity = true
+	}
+	resumed.Segments[0].Discontinuity = discontinuity
+	log.Printf("Stitching %d kept segments to %d resumed ones, discontinuity: %v", len(r.Segments), len(resumed.Segments), discontinuity)
+
+	if err := writeMediaPlaylist(filepath.Join(outFolder, hlsSegmentsFilename), append(r.Segments, resumed.Segments...)); err != nil {
+		return err
+	}
+	os.Remove(resumedPath)
+	return nil
+}
+
+// Whether the first resumed segment doesn't start where the kept ones end.
+func (r hlsResume) needsDiscontinuity(outFolder string, firstResumed mediaSegment) (bool, error) {
+	firstProbe, err := probe(filepath.Join(outFolder, r.Segments[0].URI))
+	if err != nil {
+		return false, err
+	}
+	resumedProbe, err := probe(filepath.Join(outFolder, firstResumed.URI))
+	if err != nil {
+		return false, err
+	}
+	firstStart, err := strconv.ParseFloat(firstProbe.Format.Start_time, 64)
+	if err != nil {
+		return false, err
+	}
+	resumedStart, err := strconv.ParseFloat(resumedProbe.Format.Start_time, 64)
+	if err != nil {
+		return false, err
+	}
+	difference := resumedStart - (firstStart + r.Start)
+	log.Printf("Resumed segments start %.3fs from where the kept ones end", difference)
+	return math.Abs(difference) > resumeTimestampTolerance, nil
+}
+
+// Clears the staging folder on startup, except for partial transcodes which can be resumed: ones whose source is still in New, unchanged.
+// Anything else there is left over from before, as items are moved out when complete.
+func tidyStaging(paths Paths) {
+	entries, _ := os.ReadDir(paths.Staging)
+	for _, entry := range entries {
+		path := filepath.Join(paths.Staging, entry.Name())
+		if entry.IsDir() && isResumable(path, paths) {
+			log.Println("Keeping partial transcode in staging, so it can be resumed:", entry.Name())
+			continue
+		}
+		os.RemoveAll(path)
+	}
+}
+
+// TV episodes are transcoded straight into their folder in the library, so do the same there on startup: keep partial transcodes
+// which can be resumed, and remove the rest, which have a manifest as they were interrupted.
+func tidyPartialEpisodes(paths Paths) {
+	for _, showFolder := range directoriesIn(paths.TV) {
+		for _, seasonFolder := range directoriesIn(showFolder) {
+			for _, episodeFolder := range directoriesIn(seasonFolder) {
+				if !exists(filepath.Join(episodeFolder, resumeManifestFilename)) {
+					continue
+				}
+				if isResumable(episodeFolder, paths) {
+					log.Println("Keeping partial transcode in the TV folder, so it can be resumed:", episodeFolder)
+					continue
+				}
+				log.Println("Removing partial transcode from the TV folder, as it can't be resumed:", episodeFolder)
+				os.RemoveAll(episodeFolder)
+			}
+		}
+	}
+}
+
+// Whether the folder has a partial transcode whose source is still in New, unchanged.
+func isResumable(outFolder string, paths Paths) bool {
+	playlist, err := readMediaPlaylist(filepath.Join(outFolder, hlsSegmentsFilename))
+	if err != nil || playlist.Ended || len(playlist.Segments) == 0 {
+		return false
+	}
+	var manifest resumeManifest
+	if err := readAndUnmarshal(outFolder, resumeManifestFilename, &manifest); err != nil {
+		return false
+	}
+	return strings.HasPrefix(manifest.Source, paths.NewBase+string(filepath.Separator)) && manifest.sourceUnchanged()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Subtitle files that can be dropped in alongside a video, eg 'Movie.en.srt' for 'Movie.mkv'.
+const sidecarSubtitleExtensions = "srt ass ssa vtt"
+
+// Flags for processing, which can be in a video's name but not its sidecars', eg 'deinterlace' or 'AudioStream2'.
+var processingFlagRegex = regexp.MustCompile(`^(deinterlace|burnsubs|confirmed|scalecrop1080|crop1920_940Ratio|scalecrop1920_940|scalecrop239letterbox1080|scalecrop239letterbox1920_940|` +
+	`crop240LetterboxThenUnivisium|crop235LetterboxThenUnivisium|crop240LetterboxThen169|crop235LetterboxThen169|cropScaleDown4kWideToUnivisium|` +
+	`scaleInside1920_1080MaintainingRatio|crop235LetterboxThenUnivisiumThen1920|crop4k240LetterboxThenUnivisiumThen1920|crop240LetterboxDVDThenUnivisium|` +
+	`AudioStream(\d+|X)|VideoStream\d+|preset-\w+|DVDTitle\d+)$`)
+
+// Returns true if it's the extension of a subtitles sidecar.
+func isSidecarSubtitleExtension(extension string) bool {
+	lowerExtension := strings.ToLower(extension)
+	for _, e := range strings.Split(sidecarSubtitleExtensions, " ") {
+		if "."+e == lowerExtension {
+			return true
+		}
+	}
+	return false
+}
+
+type sidecarSubtitle struct {
+	Path            string
+	Language        string // As found in the name, eg 'en', or "" if there wasn't one.
+	Forced          bool   // 'forced' was in the name.
+	HearingImpaired bool   // 'sdh' or 'cc' was in the name.
+}
+
+// Finds the subtitles sidecars that belong to the given video, matching by name.
+// Eg for 'Movie.2001.deinterlace.vob', 'Movie.2001.en.srt' and 'Movie.2001.deinterlace.fr.forced.srt' both match.
+// Anything else extra in the video's name means it's not a match, so eg 'Show.en.srt' isn't taken by 'Show.S01E01.mkv'.
+// The video needn't exist any more, so this can be used after it's been moved.
+func sidecarSubtitlesFor(videoPath string) []sidecarSubtitle {
+	folder := filepath.Dir(videoPath)
+	videoBase := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	sidecars := make([]sidecarSubtitle, 0)
+	files, _ := ioutil.ReadDir(folder)
+	for _, file := range files {
+		if file.IsDir() || !isSidecarSubtitleExtension(filepath.Ext(file.Name())) {
+			continue
+		}
+
+		// Peel the language etc off the end of the name, eg 'Movie.en.forced' -> 'Movie'.
+		sidecar := sidecarSubtitle{Path: filepath.Join(folder, file.Name())}
+		tokens := strings.Split(strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), ".")
+		for len(tokens) > 1 {
+			last := strings.ToLower(tokens[len(tokens)-1])
+			if last == "forced" {
+				sidecar.Forced = true
+			} else if last == "sdh" || last == "cc" {
+				sidecar.HearingImpaired = true
+			} else if _, ok := languageFor(last); ok && sidecar.Language == "" {
+				sidecar.Language = last
+			} else {
+				break
+			}
+			tokens = tokens[:len(tokens)-1]
+		}
+
+		// The video can have extra flags in its name that the sidecar doesn't, eg 'deinterlace'.
+		sidecarBase := strings.Join(tokens, ".")
+		if videoBase == sidecarBase || (strings.HasPrefix(videoBase, sidecarBase+".") && areAllProcessingFlags(strings.TrimPrefix(videoBase, sidecarBase+"."))) {
+			sidecars = append(sidecars, sidecar)
+		}
+	}
+	return sidecars
+}
+
+// Whether the extra bit of a name is only processing flags, eg 'deinterlace.AudioStream2'.
+func areAllProcessingFlags(extra string) bool {
+	for _, flag := range strings.FieldsFunc(extra, func(r rune) bool { return r == '.' || r == ' ' }) {
+		if !processingFlagRegex.MatchString(flag) {
+			return false
+		}
+	}
+	return true
+}
+
+// Makes a stream that describes the sidecar, so it can be labelled the same way as embedded subtitles.
+func (s sidecarSubtitle) asProbeStream() ProbeStream {
+	stream := ProbeStream{
+		Codec_type: "subtitle",
+		Codec_name: strings.TrimPrefix(strings.ToLower(filepath.Ext(s.Path)), "."),
+	}
+	stream.Tags.Language = s.Language
+	if s.Forced {
+		stream.Disposition.Forced = 1
+	}
+	if s.HearingImpaired {
+		stream.Disposition.Hearing_impaired = 1
+	}
+	return stream
+}
+
+// Removes the original file and any subtitles that came with it, once it's been successfully processed.
+func removeSource(inPath string) {
+	recordDiscResult(inPath, discResultDone)
+	for _, sidecar := range sidecarSubtitlesFor(inPath) {
+		os.Remove(sidecar.Path)
+	}
+	os.Remove(inPath)
+}
+
+// Moves the original file and any subtitles that came with it to the Failed folder.
+func moveToFailed(inPath string, paths Paths) {
+	recordDiscResult(inPath, discResultFailed)
+	for _, sidecar := range sidecarSubtitlesFor(inPath) {
+		os.Rename(sidecar.Path, filepath.Join(paths.Failed, filepath.Base(sidecar.Path)))
+	}
+	os.Rename(inPath, filepath.Join(paths.Failed, filepath.Base(inPath)))
+}
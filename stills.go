@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Where in the video (as a fraction of its duration) to look for stills. They're spread out so the images aren't all the same.
+const (
+	stillPositionEpisode  = 0.3
+	stillPositionPoster   = 0.4
+	stillPositionSeason   = 0.45
+	stillPositionBackdrop = 0.5
+)
+
+// Generates any of a movie's images that TMDB didn't supply, eg for '!' files.
+func generateMovieStillsIfNeeded(folder string) {
+	generateStillIfNeeded(folder, folder, imageFilename, stillPositionPoster)
+	generateStillIfNeeded(folder, folder, imageBackdropFilename, stillPositionBackdrop)
+}
+
+// Generates any of a show/season/episode's images that TVDB didn't supply, eg for '!' files, or episodes without a screenshot.
+func generateTVStillsIfNeeded(showFolder string, seasonFolder string, episodeFolder string) {
+	generateStillIfNeeded(episodeFolder, episodeFolder, imageFilename, stillPositionEpisode)
+	generateStillIfNeeded(episodeFolder, seasonFolder, imageFilename, stillPositionSeason)
+	generateStillIfNeeded(episodeFolder, showFolder, imageFilename, stillPositionPoster)
+	generateStillIfNeeded(episodeFolder, showFolder, imageBackdropFilename, stillPositionBackdrop)
+}
+
+// Makes folder/filename from a frame of the HLS in hlsFolder, if the image doesn't already exist.
+func generateStillIfNeeded(hlsFolder string, folder string, filename string, position float64) {
+	path := filepath.Join(folder, filename)
+	if exists(path) {
+		return
+	}
+	log.Println("No image, so generating one from the video:", path)
+	if err := generateStill(hlsFolder, path, position); err != nil {
+		log.Println("Couldn't generate the image:", err)
+	}
+}
+
+// Grabs a representative frame from around the position, skipping black and blurry frames with ffmpeg's thumbnail filter.
+// It's made as a temporary file first, then copied only if there's still no image, so one the user adds in the meantime is never overwritten.
+func generateStill(hlsFolder string, path string, position float64) error {
+	playlist, err := readMediaPlaylist(filepath.Join(hlsFolder, hlsSegmentsFilename))
+	if err != nil {
+		return err
+	}
+	duration := 0.0
+	for _, segment := range playlist.Segments {
+		duration += segment.Duration
+	}
+	if duration <= 0 {
+		return errors.New("The video has no duration")
+	}
+
+	tempPath := path + ".temp.jpg"
+	defer os.Remove(tempPath)
+	args := []string{
+		"-ss", fmt.Sprintf("%f", duration*position),
+		"-i", filepath.Join(hlsFolder, hlsSegmentsFilename),
+		"-an", "-sn",
+		"-vf", "thumbnail=300,scale=iw*sar:ih", // Picks the most typical of the next 300 frames, and makes the pixels square.
+		"-frames:v", "1",
+		"-q:v", "3",
+		"-y", tempPath,
+	}
+	if _, err := ffmpeg(args); err != nil {
+		return err
+	}
+	if !isNonEmptyFile(tempPath) {
+		return errors.New("ffmpeg didn't make an image")
+	}
+
+	// O_EXCL fails if the file exists, so it's never overwritten.
+	source, err := os.Open(tempPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		if os.IsExist(err) {
+			log.Println("An image appeared while generating one, so keeping that instead:", path)
+			return nil
+		}
+		return err
+	}
+	_, copyErr := io.Copy(destination, source)
+	closeErr := destination.Close()
+	if copyErr != nil {
+		os.Remove(path)
+		return copyErr
+	}
+	return closeErr
+}
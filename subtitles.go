@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Subtitle codecs that ffmpeg can convert to WebVTT, as opposed to bitmap ones from DVDs/Blu-rays.
+const textSubtitleCodecs = "subrip srt ass ssa webvtt mov_text text"
+
+// Subtitle codecs that are pictures, which can only be burned into the video.
+const bitmapSubtitleCodecs = "dvd_subtitle dvdsub hdmv_pgs_subtitle pgssub dvb_subtitle xsub"
+
+func isTextSubtitle(stream ProbeStream) bool {
+	return isCodecInList(stream.Codec_name, textSubtitleCodecs)
+}
+
+func isBitmapSubtitle(stream ProbeStream) bool {
+	return isCodecInList(stream.Codec_name, bitmapSubtitleCodecs)
+}
+
+func isCodecInList(codec string, list string) bool {
+	for _, c := range strings.Split(list, " ") {
+		if codec == c {
+			return true
+		}
+	}
+	return false
+}
+
+// Decides which bitmap subtitles stream, if any, to burn into the video.
+// Forced ones are always burned in, as they're the only way to understand the foreign parts.
+// Otherwise it only happens if the filename contains 'burnsubs', in which case the default one (or else the first) is used.
+// Any others are dropped, as they can't be converted to WebVTT.
+func bitmapSubtitleToBurnIn(streams []ProbeStream, inPath string) *ProbeStream {
+	bitmapStreams := make([]ProbeStream, 0)
+	for _, stream := range streams {
+		if isBitmapSubtitle(stream) {
+			bitmapStreams = append(bitmapStreams, stream)
+		}
+	}
+	if len(bitmapStreams) == 0 {
+		return nil
+	}
+
+	var burn *ProbeStream
+	for i, stream := range bitmapStreams {
+		if stream.Disposition.Forced == 1 {
+			burn = &bitmapStreams[i]
+			break
+		}
+	}
+	if burn == nil && strings.Contains(strings.ToLower(inPath), "burnsubs") {
+		burn = &bitmapStreams[0]
+		for i, stream := range bitmapStreams {
+			if stream.Disposition.Default == 1 {
+				burn = &bitmapStreams[i]
+				break
+			}
+		}
+	}
+
+	for _, stream := range bitmapStreams {
+		if burn != nil && stream.Index == burn.Index {
+			log.Printf("Burning bitmap subtitles stream %d (%s) into the video", stream.Index, stream.Codec_name)
+		} else {
+			log.Printf("Dropping bitmap subtitles stream %d (%s), as it can't be converted to WebVTT. Add 'burnsubs' to the filename to burn it in instead.", stream.Index, stream.Codec_name)
+		}
+	}
+	return burn
+}
+
+// Makes video args that burn the subtitles in using the overlay filter, in a filter graph.
+// A filter graph can't be mixed with -vf, so any -vf filter is folded into the graph after the overlay.
+// As with ffmpeg itself, only the last -vf counts.
+// Returns the new args, and what to -map as the video.
+func burnInSubtitlesArgs(videoArgs []string, videoStreamIndex int, subtitleStreamIndex int) ([]string, string) {
+	graph := fmt.Sprintf("[0:%d][0:%d]overlay", videoStreamIndex, subtitleStreamIndex)
+	args := make([]string, 0)
+	vf := ""
+	for i := 0; i < len(videoArgs); i++ {
+		if videoArgs[i] == "-vf" && i+1 < len(videoArgs) {
+			vf = videoArgs[i+1]
+			i++
+		} else {
+			args = append(args, videoArgs[i])
+		}
+	}
+	if vf != "" {
+		graph += "," + vf
+	}
+	graph += "[burnt]"
+	return append(args, "-filter_complex", graph), "[burnt]"
+}
+
+// One subtitles track as listed in the master playlist.
+type subtitleRendition struct {
+	Playlist        string // Eg 'subtitles1.m3u8', relative to the master playlist.
+	Name            string // Eg 'English (Forced)', must be unique.
+	Language        string // Eg 'en', or "" if unknown.
+	Default         bool
+	Forced          bool // Only shown for the foreign parts, players show these automatically.
+	HearingImpaired bool
+}
+
+// The EXT-X-MEDIA line for the master playlist.
+func (r subtitleRendition) mediaTag() string {
+	tag := fmt.Sprintf("#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=%q,DEFAULT=%s,AUTOSELECT=YES,FORCED=%s", r.Name, yesNo(r.Default), yesNo(r.Forced))
+	if r.Language != "" {
+		tag += fmt.Sprintf(",LANGUAGE=%q", r.Language)
+	}
+	if !r.Forced {
+		characteristics := "public.accessibility.transcribes-spoken-dialog"
+		if r.HearingImpaired {
+			characteristics += ",public.accessibility.describes-music-and-sound"
+		}
+		tag += fmt.Sprintf(",CHARACTERISTICS=%q", characteristics)
+	}
+	return tag + fmt.Sprintf(",URI=%q", r.Playlist)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "YES"
+	}
+	return "NO"
+}
+
+// Figures out the renditions for the given subtitle streams, labelled as per their tags and dispositions.
+// Only the first stream flagged as default is made the default.
+func subtitleRenditionsFor(streams []ProbeStream) []subtitleRendition {
+	renditions := make([]subtitleRendition, 0)
+	usedNames := make(map[string]bool)
+	hasDefault := false
+	for i, stream := range streams {
+		rendition := subtitleRendition{
+			Playlist:        fmt.Sprintf("subtitles%d.m3u8", i+1),
+			Forced:          stream.Disposition.Forced == 1,
+			HearingImpaired: stream.Disposition.Hearing_impaired == 1,
+		}
+		if !hasDefault && stream.Disposition.Default == 1 {
+			rendition.Default = true
+			hasDefault = true
+		}
+
+		// Label it.
+		name := stream.Tags.Title
+		if l, ok := languageFor(stream.Tags.Language); ok {
+			rendition.Language = l.Code
+			if name == "" {
+				name = l.Name
+			}
+		}
+		if name == "" {
+			name = fmt.Sprintf("Subtitles %d", i+1)
+		}
+		if rendition.Forced && !strings.Contains(strings.ToLower(name), "forced") {
+			name += " (Forced)"
+		}
+		uniqueName := name
+		for n := 2; usedNames[uniqueName]; n++ {
+			uniqueName = fmt.Sprintf("%s %d", name, n)
+		}
+		usedNames[uniqueName] = true
+		rendition.Name = uniqueName
+
+		renditions = append(renditions, rendition)
+	}
+	return renditions
+}
+
+// Somewhere to get subtitles from: either a stream in the video, or a sidecar file.
+type subtitleInput struct {
+	Path   string      // The file to read them from.
+	Map    string      // Which stream of that file, eg '0:3'.
+	Stream ProbeStream // Used for labelling.
+}
+
+// Extracts each text subtitle stream, and any sidecar subtitle files, into their own WebVTT file.
+// Each is then split into segments matching the video's segments, with a playlist for each.
+// streams are the video's text subtitle streams, as per textSubtitles.
+// Returns the renditions that were successfully extracted, to go in the master playlist.
+func extractSubtitles(inPath string, outFolder string, streams []ProbeStream, videoSegments []mediaSegment, mpegtsStart *int64) []subtitleRendition {
+	inputs := make([]subtitleInput, 0)
+	for _, stream := range streams {
+		inputs = append(inputs, subtitleInput{Path: inPath, Map: fmt.Sprintf("0:%d", stream.Index), Stream: stream})
+	}
+	for _, sidecar := range sidecarSubtitlesFor(inPath) {
+		log.Println("Found subtitles sidecar", filepath.Base(sidecar.Path))
+		inputs = append(inputs, subtitleInput{Path: sidecar.Path, Map: "0:s:0", Stream: sidecar.asProbeStream()})
+	}
+
+	labelStreams := make([]ProbeStream, 0)
+	for _, input := range inputs {
+		labelStreams = append(labelStreams, input.Stream)
+	}
+	renditions := subtitleRenditionsFor(labelStreams)
+	extracted := make([]subtitleRendition, 0)
+	for i, input := range inputs {
+		rendition := renditions[i]
+		vttFilename := strings.TrimSuffix(rendition.Playlist, filepath.Ext(rendition.Playlist)) + ".vtt"
+
+		// Extract the VTT.
+		log.Printf("Extracting subtitles %s from %s as '%s'", input.Map, filepath.Base(input.Path), rendition.Name)
+		vttPath := filepath.Join(outFolder, vttFilename)
+		args := []string{
+			"-i", input.Path, // Select the input file.
+			"-map", input.Map, // Select this subtitles track only.
+			vttPath,
+		}
+		result, err := ffmpeg(args)
+		if err != nil || !isNonEmptyFile(vttPath) {
+			log.Println("Extracting subs failed, so they won't be listed, however I'll continue anyway. Output was as follows:")
+			log.Println(string(result))
+			os.Remove(vttPath)
+			continue
+		}
+
+		// Split it to line up with the video segments, and write the subs m3u8.
+		vtt, _ := os.ReadFile(vttPath)
+		if err := writeSegmentedWebVTT(outFolder, rendition.Playlist, parseWebVTT(string(vtt)), videoSegments, mpegtsStart); err != nil {
+			log.Println("Couldn't write the segmented subtitles, so they won't be listed:", err)
+			continue
+		}
+		extracted = append(extracted, rendition)
+	}
+	return extracted
+}
+
+func isNonEmptyFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Size() > 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	surroundPlaylistFilename = "surround.m3u8"
+	surroundInitFilename     = "surround_init.mp4" // Only for fmp4 segments. It can't share init.mp4 with the video.
+)
+
+// The surround audio, kept as a second rendition alongside the stereo one, for players hooked up to a surround system.
+type surroundAudio struct {
+	StreamIndex int
+	Args        []string // How to make it, eg copying AC-3.
+	Codec       string   // As per the master playlist's CODECS, eg 'ac-3'.
+	Channels    int
+	Language    string // Eg 'en', or "" if unknown.
+}
+
+// Figures out how to keep the stream's surround audio, or nil if it isn't wanted or the stream is only stereo.
+// AC-3 and E-AC-3 are copied as players support them, anything else is converted to 5.1 AAC.
+func surroundAudioFor(stream ProbeStream, config Config) *surroundAudio {
+	if !config.KeepSurround || stream.Channels <= 2 {
+		return nil
+	}
+	surround := &surroundAudio{StreamIndex: stream.Index}
+	if l, ok := languageFor(stream.Tags.Language); ok {
+		surround.Language = l.Code
+	}
+	if stream.Codec_name == "ac3" || stream.Codec_name == "eac3" {
+		surround.Args = []string{"-acodec", "copy"}
+		surround.Codec = hlsCodecFor(stream)
+		surround.Channels = stream.Channels
+	} else {
+		surround.Args = []string{"-acodec", "aac", "-b:a", "384k", "-af", "aformat=channel_layouts=5.1"}
+		surround.Codec = "mp4a.40.2"
+		surround.Channels = 6
+	}
+	return surround
+}
+
+// Normalises the loudness to the target, as with the stereo, so switching between them doesn't change the volume.
+// Copying can't change the loudness, so AC-3 and E-AC-3 are re-encoded as AC-3, which any player that takes the copied ones supports.
+func (s *surroundAudio) normaliseLoudness(inPath string, target float64) error {
+	codecArgs := []string{"-acodec", "aac", "-b:a", "384k"}
+	codec := "mp4a.40.2"
+	if isCopying(s.Args) {
+		codecArgs = []string{"-acodec", "ac3", "-b:a", "640k"}
+		codec = "ac-3"
+	}
+	var filters []string
+	channels := s.Channels
+	if !isCopying(s.Args) || s.Channels > 6 {
+		filters = append(filters, "aformat=channel_layouts=5.1") // AC-3 only goes up to 5.1.
+		channels = 6
+	}
+	measurement, err := measureLoudness(inPath, s.StreamIndex, filters, target)
+	if err != nil {
+		return err
+	}
+	filters = append(filters, measurement.filter(target))
+	s.Args = append(codecArgs, "-ar", "48000", "-af", strings.Join(filters, ",")) // loudnorm upsamples to 192kHz otherwise.
+	s.Codec = codec
+	s.Channels = channels
+	return nil
+}
+
+// The ffmpeg args for the second output, which is just the surround audio, as its own media playlist.
+// Being in the same ffmpeg run as the video means the timestamps line up.
+func (s surroundAudio) outputArgs(outFolder string, segmentType string) []string {
+	args := []string{"-map", fmt.Sprintf("0:%d", s.StreamIndex), "-vn", "-sn"}
+	args = append(args, s.Args...)
+	if segmentType == hlsSegmentTypeFMP4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", surroundInitFilename)
+	}
+	return append(args, "-hls_list_size", "0", filepath.Join(outFolder, surroundPlaylistFilename))
+}
+
+// The renditions for the master playlist: the stereo that's in the video's segments, which is the default, then this.
+func (s surroundAudio) renditions() []audioRendition {
+	name := fmt.Sprintf("Surround %d channels", s.Channels)
+	if s.Channels == 6 {
+		name = "Surround 5.1"
+	} else if s.Channels == 8 {
+		name = "Surround 7.1"
+	}
+	return []audioRendition{
+		{Name: "Stereo", Language: s.Language, Channels: 2, Default: true},
+		{Playlist: surroundPlaylistFilename, Name: name, Language: s.Language, Channels: s.Channels},
+	}
+}
+
+// An audio rendition, as listed in the master playlist.
+type audioRendition struct {
+	Playlist string // "" means it's in the video's segments.
+	Name     string
+	Language string // Eg 'en', or "" if unknown.
+	Channels int
+	Default  bool
+}
+
+// The EXT-X-MEDIA line for the master playlist.
+func (r audioRendition) mediaTag() string {
+	tag := fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=%q,DEFAULT=%s,AUTOSELECT=YES,CHANNELS=\"%d\"", r.Name, yesNo(r.Default), r.Channels)
+	if r.Language != "" {
+		tag += fmt.Sprintf(",LANGUAGE=%q", r.Language)
+	}
+	if r.Playlist != "" {
+		tag += fmt.Sprintf(",URI=%q", r.Playlist)
+	}
+	return tag
+}
@@ -11,7 +11,9 @@ import (
 // Expects eg 'Big.Buck.Bunny.2008.blahblah.vob'
 // Nice-ify the title for a filename. Best case, becomes "Some movie", 2016.
 // If it cannot find year, returns a nil year pointer.
+// Processing flags, eg 'deinterlace' or 'confirmed', aren't part of the title.
 func titleAndYearFromFilename(file string) (string, *int) {
+	file = withoutProcessingFlags(file)
 	// Try to figure out the year and title.
 	regex := regexp.MustCompile("\\d{4}")
 	yearString := regex.FindString(file)
@@ -31,6 +33,18 @@ func titleAndYearFromFilename(file string) (string, *int) {
 	}
 }
 
+// Removes dot-separated processing flags, eg 'Movie.confirmed.vob' becomes 'Movie.vob'.
+func withoutProcessingFlags(file string) string {
+	extension := filepath.Ext(file)
+	tokens := make([]string, 0)
+	for _, token := range strings.Split(strings.TrimSuffix(file, extension), ".") {
+		if !processingFlagRegex.MatchString(token) {
+			tokens = append(tokens, token)
+		}
+	}
+	return strings.Join(tokens, ".") + extension
+}
+
 func showSeasonEpisodeFromFile(file string) (string, int, int, error) {
 	// Try to figure out the year and title.
 	regex := regexp.MustCompile(`(?i)(.*)S(\d+)E(\d+)`)
@@ -56,3 +70,26 @@ func audioStreamFromFile(file string) *int {
 		return nil
 	}
 }
+
+// Find `VideoStreamX` in a file and returns X. Or nil if it can't find.
+func videoStreamFromFile(file string) *int {
+	regex := regexp.MustCompile(`VideoStream(\d+)`)
+	matches := regex.FindStringSubmatch(file)
+	if len(matches) >= 2 {
+		index, _ := strconv.Atoi(matches[1])
+		return &index
+	} else {
+		return nil
+	}
+}
+
+// Find `preset-X` in a file and returns X, the name of an encoder preset from the config. Or "" if it can't find.
+func encoderPresetFromFile(file string) string {
+	regex := regexp.MustCompile(`preset-(\w+)`)
+	matches := regex.FindStringSubmatch(file)
+	if len(matches) >= 2 {
+		return matches[1]
+	} else {
+		return ""
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 )
 
@@ -20,7 +19,7 @@ func (e *convertRenamedError) Error() string {
 }
 
 // Tries to convert the given video to hls.
-func convertToHLSAppropriately(inPath string, outFolder string, config Config) error {
+func convertToHLSAppropriately(inPath string, outFolder string, config Config, paths Paths) error {
 	if config.DebugSkipHLS {
 		// Skip conversion, this is good for debugging.
 		log.Println("Not converting to HLS due to DebugSkipHLS flag")
@@ -51,12 +50,30 @@ func convertToHLSAppropriately(inPath string, outFolder string, config Config) e
 		// Easy case, just one to choose from.
 		audioStream = audioStreams[0]
 	} else {
-		// More than one audio. Either need to make the user choose, or take their choice.
+		// More than one audio. Either take the user's choice, pick one as per the config's rules, or make the user choose.
 		indexFromFilename := audioStreamFromFile(inPath)
-		if indexFromFilename == nil {
-			// User hasn't made a selection.
+		if indexFromFilename != nil {
+			for _, stream := range audioStreams {
+				if stream.Index == *indexFromFilename {
+					audioStream = stream
+				}
+			}
+
+			// Did it find it?
+			if audioStream.Index != *indexFromFilename {
+				return errors.New("Couldn't find the stream with the index as per the filename")
+			}
+		} else if selected := selectAudioStream(audioStreams, config.AudioSelection); selected != nil {
+			audioStream = *selected
+		} else {
+			// User hasn't made a selection, and the rules couldn't either.
 			log.Printf("Too many audio streams, splitting them out and forcing the user to choose one.")
+			defaultAudio := probeResult.defaultAudio()
 			for _, stream := range audioStreams {
+				previewName := fmt.Sprintf(".AudioStream%d preview.mp3", stream.Index)
+				if defaultAudio != nil && stream.Index == defaultAudio.Index {
+					previewName = fmt.Sprintf(".AudioStream%d default preview.mp3", stream.Index) // So the user can tell which one the file suggests.
+				}
 				args := []string{
 					// "-ss", "60", // Start from 60s
 					"-t", "180", // Only grab Xs
@@ -64,7 +81,7 @@ func convertToHLSAppropriately(inPath string, outFolder string, config Config) e
 					"-map", fmt.Sprintf("0:%d", stream.Index),
 					"-ac", "1", // Make it mono for speed and size.
 					"-b:a", "64k", // CBR so it previews nicely on osx.
-					inPath + fmt.Sprintf(".AudioStream%d preview.mp3", stream.Index),
+					inPath + previewName,
 				}
 				ffmpeg(args) // TODO handle errors one day. This *should* work if probing succeeded earlier however.
 			}
@@ -74,41 +91,65 @@ func convertToHLSAppropriately(inPath string, outFolder string, config Config) e
 			newName := nameSansExt + ".AudioStreamX" + ext + ".please insert correct audio stream number then remove this"
 			os.Rename(inPath, newName)
 			return &convertRenamedError{text: "Too many audio streams"}
-		} else {
-			for _, stream := range audioStreams {
-				if stream.Index == *indexFromFilename {
-					audioStream = stream
-				}
-			}
-
-			// Did it find it?
-			if audioStream.Index != *indexFromFilename {
-				return errors.New("Couldn't find the stream with the index as per the filename")
-			}
 		}
 	}
 
 	// Figure out what to do with the audio.
 	var audioCommand []string
-	if audioStream.Channel_layout == "stereo" && audioStream.Codec_name == "aac" {
+	var audioFilters []string
+	normalise := config.LoudnessTarget != 0
+	if audioStream.Channel_layout == "stereo" && audioStream.Codec_name == "aac" && !normalise {
 		audioCommand = []string{"-acodec", "copy"} // Best case, can leave as-is.
 	} else if audioStream.Channel_layout == "stereo" {
 		audioCommand = []string{"-strict", "experimental", "-b:a", "192k"} // Transcode, same channels.
-	} else if audioStream.Channel_layout == "5.1" { // FL+FR+FC+LFE+BL+BR
-		// Tweak the 5.1 conversion, as by default it is quiet and drops the subwoofer.
-		log.Println("Using custom downmix from 5.1 to stereo that preserves bass and speech")
-		audioCommand = []string{"-strict", "experimental", "-b:a", "192k", "-af", "pan=stereo|FL<FL+BL+FC+LFE|FR<FR+BR+FC+LFE"}
-	} else if audioStream.Channel_layout == "5.1(side)" { // FL+FR+FC+LFE+SL+SR
-		log.Println("Using custom downmix from 5.1 to stereo that preserves bass and speech")
-		audioCommand = []string{"-strict", "experimental", "-b:a", "192k", "-af", "pan=stereo|FL<FL+SL+FC+LFE|FR<FR+SR+FC+LFE"}
+	} else if downmix, ok := downmixFilterFor(audioStream.Channel_layout, config); ok {
+		// Custom downmix, as by default it is quiet and drops the subwoofer.
+		audioCommand = []string{"-strict", "experimental", "-b:a", "192k"}
+		audioFilters = append(audioFilters, downmix)
+	} else if normalise {
+		// Same as `-ac 2`, but as a filter, so the loudness is measured after the downmix.
+		log.Println("Using default downmix due to unexpected channel layout:", audioStream.Channel_layout)
+		audioCommand = []string{"-strict", "experimental", "-b:a", "192k"}
+		audioFilters = append(audioFilters, "aformat=channel_layouts=stereo")
 	} else {
 		log.Println("Using `-ac 2` due to unexpected channel layout:", audioStream.Channel_layout)
 		audioCommand = []string{"-strict", "experimental", "-b:a", "192k", "-ac", "2"} // Lousy cover-all.
 	}
 
+	// Two-pass loudness normalisation: measure it now, then correct it while transcoding.
+	if normalise {
+		measurement, measureErr := measureLoudness(inPath, audioStream.Index, audioFilters, config.LoudnessTarget)
+		if measureErr != nil {
+			log.Println("Couldn't measure the loudness, so it won't be normalised:", measureErr)
+		} else {
+			log.Printf("Normalising loudness to %.1f LUFS", config.LoudnessTarget)
+			audioFilters = append(audioFilters, measurement.filter(config.LoudnessTarget))
+			audioCommand = append(audioCommand, "-ar", "48000") // loudnorm upsamples to 192kHz otherwise.
+		}
+	}
+	if len(audioFilters) > 0 {
+		audioCommand = append(audioCommand, "-af", strings.Join(audioFilters, ","))
+	}
+
+	// Keep the surround audio too, if wanted.
+	surround := surroundAudioFor(audioStream, config)
+	if surround != nil && normalise {
+		if err := surround.normaliseLoudness(inPath, config.LoudnessTarget); err != nil {
+			log.Println("Couldn't measure the surround audio's loudness, so it won't be normalised:", err)
+		} else {
+			log.Printf("Normalising the surround audio's loudness to %.1f LUFS too", config.LoudnessTarget)
+		}
+	}
+	if surround != nil {
+		log.Printf("Keeping the %d channel audio as a second rendition, with: %+v", surround.Channels, surround.Args)
+	}
+
 	// Figure out what to do with the video.
-	videoStream := videoStreams[0]
-	duration, _ := strconv.ParseFloat(probeResult.Format.Duration, 64)
+	videoStream, videoErr := selectVideoStream(videoStreams, inPath)
+	if videoErr != nil {
+		return videoErr
+	}
+	duration := probeResult.Format.durationSeconds()
 	deinterlace := strings.Contains(inPath, "deinterlace")
 	scaleAndCrop := strings.Contains(inPath, "scalecrop1080")
 	crop1920_940Ratio := strings.Contains(inPath, "crop1920_940Ratio") // For 1920xshort (eg 800) inputs.
@@ -120,13 +161,32 @@ func convertToHLSAppropriately(inPath string, outFolder string, config Config) e
 	crop240LetterboxThen169 := strings.Contains(inPath, "crop240LetterboxThen169")
 	crop235LetterboxThen169 := strings.Contains(inPath, "crop235LetterboxThen169")
 	isIncompatible := isIncompatiblePixelFormat(videoStream.Pix_fmt)
+	burnInSubtitles := bitmapSubtitleToBurnIn(probeResult.subtitleStreams(), inPath)
+	encoder, encoderErr := encoderSettingsFor(inPath, config)
+	if encoderErr != nil {
+		return encoderErr
+	}
+	reencoder := encoder // In case copying fails.
+	isFiltered := deinterlace || scaleAndCrop || burnInSubtitles != nil
+	isFMP4 := config.HLSSegmentType == hlsSegmentTypeFMP4
 	var videoArgs []string
-	if videoStream.Codec_name == "h264" && videoStream.Codec_tag_string != "avc1" && !isIncompatible && !deinterlace && !scaleAndCrop {
-		// Can only direct copy if not avc1, or it won't be a seekable video.
+	if videoStream.Codec_name == "h264" && (videoStream.Codec_tag_string != "avc1" || isFMP4) && !isIncompatible && !isFiltered {
+		// Can only direct copy if not avc1 when making MPEG-TS, or it won't be a seekable video. fMP4 doesn't mind.
 		log.Println("Eligible for video not being transcoded, so no quality loss :)")
 		videoArgs = []string{"-vcodec", "copy"}
+		encoder = EncoderSettings{Codec: "copy", Threads: encoder.Threads}
+	} else if videoStream.Codec_name == "hevc" && isFMP4 && config.HEVCPassthrough && !isFiltered {
+		// Apple's players need it tagged hvc1 rather than hev1.
+		log.Println("Eligible for HEVC passthrough, so no quality loss and no lengthy transcode :)")
+		videoArgs = []string{"-vcodec", "copy", "-tag:v", "hvc1"}
+		encoder = EncoderSettings{Codec: "copy", Threads: encoder.Threads}
 	} else {
 		log.Println("Video not eligible for muxing without transcoding.")
+		if videoStream.isHDR() {
+			log.Printf("Video is HDR (transfer %s, primaries %s, Dolby Vision: %v), which will look washed out as SDR h264", videoStream.Color_transfer, videoStream.Color_primaries, videoStream.isDolbyVision())
+		}
+		log.Printf("Encoder settings: %+v", encoder)
+		videoArgs = append(videoArgs, encoder.videoArgs()...)
 		if isIncompatible {
 			log.Println("Video needs pixel format conversion")
 			videoArgs = append(videoArgs, "-pix_fmt", "yuv420p")
@@ -198,16 +258,139 @@ func convertToHLSAppropriately(inPath string, outFolder string, config Config) e
 		}
 	}
 
-	return runConvertToHLS(
+	videoArgs = append(videoArgs, encoder.threadsArgs()...)
+	videoMap := fmt.Sprintf("0:%d", videoStream.Index)
+	if burnInSubtitles != nil {
+		videoArgs, videoMap = burnInSubtitlesArgs(videoArgs, videoStream.Index, burnInSubtitles.Index)
+	}
+
+	// Carry on from where an interrupted transcode got to, if possible.
+	var resume *hlsResume
+	if isFMP4 {
+		log.Println("Not looking for a partial transcode to resume, as that's only supported for MPEG-TS segments")
+	} else if surround != nil {
+		log.Println("Not looking for a partial transcode to resume, as that's not supported when keeping surround audio")
+	} else {
+		hlsArgs := hlsFFmpegArgs(inPath, outFolder, filepath.Join(outFolder, hlsSegmentsFilename), audioStream.Index, videoMap, audioCommand, videoArgs, nil, nil, config.HLSSegmentType, surround)
+		resume = resumableSegments(outFolder, inPath, hlsArgs)
+		if resume != nil && isCopying(videoArgs) && !resume.Reencoding && !resume.cutAtKeyframe(inPath, videoStream.Index) {
+			log.Println("Not resuming the partial transcode, as none of its segments end on a keyframe, which copying the video needs")
+			resume = nil
+		}
+		if resume != nil {
+			log.Printf("Resuming a partial transcode from segment %d, at %.1fs", len(resume.Segments), resume.Start)
+		}
+	}
+
+	// Estimate how long it'll take, and hold it for the user to confirm if that's too long, eg on a slow board.
+	var estimate *TranscodeEstimate
+	if encoder.Codec == "copy" {
+		log.Println("Not estimating the transcode time, as the video is being copied")
+	} else if config.SkipEstimate {
+		log.Println("Not estimating the transcode time due to SkipEstimate flag")
+	} else if result, err := estimateTranscode(inPath, duration, remainingDuration(duration, resume), videoMap, videoArgs, audioStream.Index, audioCommand, surround, paths, config); err != nil {
+		log.Println("Couldn't estimate the transcode time:", err)
+	} else {
+		log.Printf("Estimated transcode: %s, from a %.1fGB source", result, float64(probeResult.Format.sizeBytes())/1e9)
+		if config.EstimateCeilingHours > 0 && float64(result.Seconds) > config.EstimateCeilingHours*3600 && !isConfirmedFile(inPath) {
+			log.Printf("That's over the %.1f hour ceiling, so renaming it for the user to confirm", config.EstimateCeilingHours)
+			return holdForConfirmation(inPath, result)
+		}
+		estimate = &result
+		if err := mergeIntoItemMetadata(outFolder, "TranscodeEstimate", result); err != nil {
+			log.Println("Couldn't record the transcode estimate in the metadata:", err)
+		}
+	}
+
+	progress := startTranscodeProgress(paths, filepath.Base(inPath), duration)
+	progress.setEstimate(estimate)
+	encoder, decoded, convertErr := runConvertToHLS(
 		inPath,
 		outFolder,
 		audioStream.Index,
-		videoStream.Index,
+		videoMap,
 		audioCommand,
 		videoArgs,
-		videoStream.Avg_frame_rate,
+		encoder,
+		reencoder,
+		reencodeVideoArgs(reencoder, isIncompatible),
+		videoStream.frameRate().float(),
 		duration,
-		probeResult.hasSubtitles())
+		probeResult.textSubtitles(),
+		config.HLSSegmentType,
+		surround,
+		resume,
+		progress)
+	progress.finish()
+	if convertErr != nil {
+		return convertErr
+	}
+
+	// Make sure it's all there before the source is deleted. What ffmpeg decoded is more reliable than the probe, eg for VOBs.
+	expectedDuration, durationIsEstimated := decoded, false
+	if decoded <= 0 {
+		log.Println("ffmpeg didn't say how much it decoded, so checking the output against the probed duration")
+		expectedDuration, durationIsEstimated = duration, probeResult.Format.durationIsEstimated()
+	}
+	if err := verifyHLS(outFolder, expectedDuration, durationIsEstimated, config.VerifySampleDecode); err != nil {
+		return fmt.Errorf("The HLS output failed verification - %v", err)
+	}
+
+	// Record what was used, so it's possible to tell which items might be worth re-doing one day.
+	if err := mergeIntoItemMetadata(outFolder, "Encoder", encoder); err != nil {
+		log.Println("Couldn't record the encoder settings in the metadata:", err)
+	}
+
+	// Keep the chapters, so players can jump to them.
+	if chapters := chaptersFrom(probeResult); len(chapters) > 0 {
+		log.Printf("Keeping %d chapters", len(chapters))
+		if err := writeChaptersVTT(outFolder, chapters); err != nil {
+			log.Println("Couldn't write the chapters track:", err)
+		}
+		if err := mergeIntoItemMetadata(outFolder, "Chapters", chapters); err != nil {
+			log.Println("Couldn't record the chapters in the metadata:", err)
+		}
+	}
+
+	// Scrubbing previews.
+	if config.SkipTrickplay {
+		log.Println("Not making scrubbing previews due to SkipTrickplay flag")
+	} else if trickplay, err := generateTrickplay(outFolder, duration, config); err != nil {
+		log.Println("Couldn't make the scrubbing previews:", err)
+	} else if err := mergeIntoItemMetadata(outFolder, "Trickplay", trickplay); err != nil {
+		log.Println("Couldn't record the scrubbing previews in the metadata:", err)
+	}
+	return nil
+}
+
+// All of ffmpeg's args for converting to HLS, writing the segments' playlist to hlsOutputPath.
+// inputArgs and outputArgs are extras, eg from recoveries or resuming.
+func hlsFFmpegArgs(inPath string, outFolder string, hlsOutputPath string, audioStreamIndex int, videoMap string, audioArgs []string, videoArgs []string, inputArgs []string, outputArgs []string, segmentType string, surround *surroundAudio) []string {
+	args := append([]string{"-y"}, inputArgs...)
+	args = append(args,
+		"-i", inPath, // Select the input file.
+		"-map", videoMap, // Select the video stream, eg '0:1', or the output of a filter graph. '0:v' would copy all video channels, but that's out of scope for this simple project.
+		"-map", fmt.Sprintf("0:%d", audioStreamIndex), // 0:a would copy all audio channels, but iOS won't let you select channels from the stock media player.
+	)
+	args = append(append(append(args, audioArgs...), videoArgs...), outputArgs...)
+	lastArgs := []string{"-hls_list_size", "0", hlsOutputPath}
+	if segmentType == hlsSegmentTypeFMP4 {
+		lastArgs = append([]string{"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", hlsInitFilename}, lastArgs...)
+	}
+	if surround != nil {
+		lastArgs = append(lastArgs, surround.outputArgs(outFolder, segmentType)...)
+	}
+	return append(args, lastArgs...)
+}
+
+// The video args for re-encoding if copying fails. The pixel format is converted if need be, as it is when re-encoding from the start,
+// eg so 10-bit HEVC doesn't become 10-bit h264, which Apple's players can't decode.
+func reencodeVideoArgs(reencoder EncoderSettings, isIncompatible bool) []string {
+	args := append(reencoder.videoArgs(), reencoder.threadsArgs()...)
+	if isIncompatible {
+		args = append(args, "-pix_fmt", "yuv420p")
+	}
+	return args
 }
 
 func isIncompatiblePixelFormat(pf string) bool {
@@ -217,91 +400,170 @@ func isIncompatiblePixelFormat(pf string) bool {
 		strings.HasSuffix(pf, "14le") || strings.HasSuffix(pf, "14be")
 }
 
-// Converts to HLS. If it gets back an error about h264_mp4toannexb, it retries with the appropriate command.
-// frameRate is as per the probe eg "24000/1001"
-func runConvertToHLS(inPath string, outFolder string, audioStreamIndex int, videoStreamIndex int, audioArgs []string, videoArgs []string, frameRateString string, duration float64, hasSubtitles bool) error {
+// Converts to HLS. If ffmpeg fails in a known way (eg needing h264_mp4toannexb), it retries with the appropriate args, and finally by re-encoding.
+// Once the segments are made, the subtitles are split to match, and the header is written.
+// videoMap is what to -map as the video, eg "0:1", or the label of a filter graph's output.
+// encoder is what videoArgs are for, and reencoder is used instead if copying the video fails, with reencodeArgs. Returns the one that was actually used.
+// frameRate is as per the probe eg 23.976, or 0 if unknown.
+// segmentType is as per the config, eg "fmp4", or blank for MPEG-TS.
+// surround is the surround audio to make as a second rendition, or nil.
+// resume is the segments of an interrupted transcode to carry on from, or nil.
+// progress is updated as ffmpeg goes, and may be nil.
+// Also returns how much ffmpeg said it decoded, in seconds, or 0 if it didn't say.
+func runConvertToHLS(inPath string, outFolder string, audioStreamIndex int, videoMap string, audioArgs []string, videoArgs []string, encoder EncoderSettings, reencoder EncoderSettings, reencodeArgs []string, frameRate float64, duration float64, subtitleStreams []ProbeStream, segmentType string, surround *surroundAudio, resume *hlsResume, progress *transcodeProgress) (EncoderSettings, float64, error) {
 	log.Printf("Converting to HLS with ffmpeg, audio: %+v; video: %+v\n", audioArgs, videoArgs)
-	hlsHeaderPath := filepath.Join(outFolder, hlsFilename)
-	var frameRate float64 = 60
-	if strings.Contains(frameRateString, "/") {
-		parts := strings.Split(frameRateString, "/")
-		a, _ := strconv.ParseFloat(parts[0], 64)
-		b, _ := strconv.ParseFloat(parts[1], 64)
-		frameRate = a / b
-	} else {
-		frameRate, _ = strconv.ParseFloat(frameRateString, 64)
+	if frameRate <= 0 {
+		frameRate = 60
 	}
-	xStreamInfSuffix := ""
-	headerSubsLine := ""
-	if hasSubtitles {
-		xStreamInfSuffix = ",SUBTITLES=\"subs\""
-		headerSubsLine = "#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"English\",DEFAULT=NO,AUTOSELECT=YES,FORCED=NO,LANGUAGE=\"en\",CHARACTERISTICS=\"public.accessibility.transcribes-spoken-dialog\",URI=\"subtitles.m3u8\"\n"
-	}
-	hlsHeaderContent := fmt.Sprintf("#EXTM3U\n%v#EXT-X-STREAM-INF:BANDWIDTH=1000000,FRAME-RATE=%f%v\n%s\n#EXT-X-ENDLIST", headerSubsLine, frameRate, xStreamInfSuffix, hlsSegmentsFilename)
-	hlsHeaderErr := os.WriteFile(hlsHeaderPath, []byte(hlsHeaderContent), os.ModePerm)
-	if hlsHeaderErr != nil {
-		log.Println("Error writing hls header:", hlsHeaderErr)
-		return hlsHeaderErr
+
+	hlsSegmentsPath := filepath.Join(outFolder, hlsSegmentsFilename)
+	var inputArgs, outputArgs []string
+	tried := make(map[string]bool)
+	var recoveries []*ffmpegRecovery
+	reencoding := false
+	reencode := func() {
+		reencoding = true
+		if isCopying(videoArgs) {
+			videoArgs = reencodeArgs
+			encoder = reencoder
+		}
+		if isCopying(audioArgs) {
+			audioArgs = []string{"-strict", "experimental", "-b:a", "192k"}
+		}
 	}
 
-	// Write the subs m3u8.
-	if hasSubtitles {
-		durationInt := int(duration)
-		subsContent := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:%d,\nsubtitles.vtt\n#EXT-X-ENDLIST", durationInt, durationInt)
-		subsPath := filepath.Join(outFolder, "subtitles.m3u8")
-		os.WriteFile(subsPath, []byte(subsContent), os.ModePerm)
+	// The manifest has the args as first tried, so it matches when resuming, and records the recoveries separately.
+	baseArgs := hlsFFmpegArgs(inPath, outFolder, hlsSegmentsPath, audioStreamIndex, videoMap, audioArgs, videoArgs, nil, nil, segmentType, surround)
 
-		// Extract the VTT.
-		vttPath := filepath.Join(outFolder, "subtitles.vtt")
-		args := []string{
-			"-i", inPath, // Select the input file.
-			"-map", "0:s:0", // Select first subtitles track only.
-			vttPath,
+	// Carry on the same way the interrupted transcode had to.
+	if resume != nil {
+		for _, name := range resume.Recoveries {
+			if recovery := ffmpegRecoveryNamed(name); recovery != nil {
+				log.Printf("Resuming with recovery: %s", name)
+				tried[name] = true
+				recoveries = append(recoveries, recovery)
+			}
 		}
-		result, err := ffmpeg(args)
-		if err != nil {
-			log.Println("Extracting subs failed, output was as follows, however I'll continue anyway:")
-			log.Println(string(result))
+		if resume.Reencoding {
+			log.Println("Resuming re-encoding everything, as copying failed before")
+			reencode()
 		}
+		inputArgs, outputArgs = ffmpegRecoveryArgs(recoveries, reencoding)
 	}
 
-	firstArgs := []string{
-		"-i", inPath, // Select the input file.
-		"-map", fmt.Sprintf("0:%d", videoStreamIndex), // Select the video stream. '0:v' would copy all video channels, but that's out of scope for this simple project.
-		"-map", fmt.Sprintf("0:%d", audioStreamIndex), // 0:a would copy all audio channels, but iOS won't let you select channels from the stock media player.
+	run := func() (string, error) {
+		if resume != nil {
+			return ffmpegWithProgress(hlsFFmpegArgs(inPath, outFolder, filepath.Join(outFolder, resumePlaylistFilename), audioStreamIndex, videoMap, audioArgs, videoArgs,
+				append(resume.inputArgs(), inputArgs...), append(outputArgs, resume.outputArgs(outFolder)...), segmentType, surround), progress)
+		}
+		allArgs := hlsFFmpegArgs(inPath, outFolder, hlsSegmentsPath, audioStreamIndex, videoMap, audioArgs, videoArgs, inputArgs, outputArgs, segmentType, surround)
+		if err := writeResumeManifest(outFolder, inPath, baseArgs, recoveries, reencoding); err != nil {
+			log.Println("Couldn't write the resume manifest, so this can't be resumed if it's interrupted:", err)
+		}
+		return ffmpegWithProgress(allArgs, progress)
 	}
-	hlsSegmentsPath := filepath.Join(outFolder, hlsSegmentsFilename)
-	lastArgs := []string{"-hls_list_size", "0", hlsSegmentsPath}
-	allArgs := append(append(append(firstArgs, audioArgs...), videoArgs...), lastArgs...)
-	result, err := ffmpeg(allArgs)
+	result, err := run()
 
-	// Print result if its an error.
-	if err != nil {
-		log.Println("Initial ffmpeg attempt failed, the output was as follows:")
+	// If it failed, try the recoveries that match the output, each on top of the last. As a last resort, re-encode everything.
+	for attempt := 1; err != nil; attempt++ {
+		log.Printf("ffmpeg attempt %d failed, the output was as follows:", attempt)
 		log.Println(string(result))
+		if resume != nil {
+			// It might be the seek that's the problem, so start over rather than mixing fixes with what was already made.
+			log.Println("Resuming failed, starting over from the beginning")
+			resume = nil
+		} else if recovery := ffmpegRecoveryFor(result, tried); recovery != nil {
+			log.Printf("Attempting to convert to HLS again, with recovery: %s", recovery.Name)
+			tried[recovery.Name] = true
+			recoveries = append(recoveries, recovery)
+			inputArgs, outputArgs = ffmpegRecoveryArgs(recoveries, reencoding)
+		} else if !reencoding && (isCopying(videoArgs) || isCopying(audioArgs)) {
+			log.Println("No recoveries left, attempting to convert to HLS again, re-encoding everything rather than copying")
+			reencode()
+			inputArgs, outputArgs = ffmpegRecoveryArgs(recoveries, reencoding)
+		} else {
+			log.Println("No recoveries left, giving up")
+			break
+		}
+		result, err = run()
+	}
+	if err != nil {
+		return encoder, 0, err
 	}
+	decoded := ffmpegDecodedSeconds(result)
+	if resume != nil {
+		if err := resume.stitch(outFolder); err != nil {
+			return encoder, 0, err
+		}
+		if decoded > 0 {
+			decoded += resume.Start // ffmpeg's time is from where it started, even with -copyts.
+		}
+	}
+	os.Remove(filepath.Join(outFolder, resumeManifestFilename)) // It's done, so there's nothing to resume.
+
+	// Now the segments exist, the subtitles can be split to match them.
+	segmentsPlaylist, playlistErr := readMediaPlaylist(hlsSegmentsPath)
+	if playlistErr != nil {
+		log.Println("Couldn't read the segments playlist, so subtitles will be one big segment:", playlistErr)
+		segmentsPlaylist.Segments = []mediaSegment{{Duration: duration}}
+	}
+	master := masterPlaylist{FrameRate: frameRate}
+	var mpegtsStart *int64
+	segmentsProbe, segmentsProbeErr := probeSegments(outFolder, segmentsPlaylist)
+	if segmentsProbeErr != nil {
+		log.Println("Couldn't probe the segments, so subtitles won't have a timestamp map, and the header won't have codecs:", segmentsProbeErr)
+	} else {
+		if start, startErr := mpegtsStartOf(segmentsProbe); startErr == nil {
+			mpegtsStart = &start
+		} else {
+			log.Println("Couldn't find the segments' start timestamp, so subtitles won't have a timestamp map:", startErr)
+		}
 
-	// Did it fail with the annex b issue? If so, retry.
-	// You can't simply *always* have h264_mp4toannexb enabled, it fails if not needed.
-	if err != nil && strings.Contains(string(result), "h264_mp4toannexb") {
-		log.Println("Attempting to convert to HLS using h264_mp4toannexb option")
-		allArgs := append(append(append(append(firstArgs, audioArgs...), videoArgs...), "-bsf:v", "h264_mp4toannexb"), lastArgs...)
-		result2, err2 := ffmpeg(allArgs)
+		// Describe what was actually produced, rather than what was asked for.
+		master.Codecs = hlsCodecsFor(segmentsProbe)
+		if outputVideo := segmentsProbe.videoStreams(); len(outputVideo) > 0 && outputVideo[0].Width > 0 {
+			master.Resolution = fmt.Sprintf("%dx%d", outputVideo[0].Width, outputVideo[0].Height)
+		}
+		if surround != nil && master.Codecs != "" && surround.Codec != "" {
+			master.Codecs += "," + surround.Codec
+		}
+		log.Printf("Output codecs: '%s', resolution: '%s'", master.Codecs, master.Resolution)
 
-		// Print result if its an error.
-		if err2 != nil {
-			log.Println("Second ffmpeg attempt failed, the output was as follows:")
-			log.Println(string(result2))
+		// I-frame playlists need byte ranges of each keyframe, which are easy to find in MPEG-TS, but not fMP4.
+		if segmentType == hlsSegmentTypeFMP4 {
+			log.Println("Not making an I-frame playlist, as that's only supported for MPEG-TS segments")
+		} else if iFrames, iFramesErr := writeIFramesPlaylist(outFolder, segmentsPlaylist.Segments); iFramesErr != nil {
+			log.Println("Couldn't make the I-frame playlist:", iFramesErr)
+		} else {
+			master.IFrames = &iFrames
+			if outputVideo := segmentsProbe.videoStreams(); len(outputVideo) > 0 {
+				master.IFrames.Codec = hlsCodecFor(outputVideo[0])
+			}
 		}
+	}
 
-		return err2
+	if surround != nil {
+		master.Audio = surround.renditions()
 	}
-	return err
+
+	// Extract the subtitles, then write the header listing them.
+	master.Subtitles = extractSubtitles(inPath, outFolder, subtitleStreams, segmentsPlaylist.Segments, mpegtsStart)
+	hlsHeaderErr := master.write(outFolder)
+	if hlsHeaderErr != nil {
+		log.Println("Error writing hls header:", hlsHeaderErr)
+		return encoder, 0, hlsHeaderErr
+	}
+	return encoder, decoded, nil
 }
 
 // Runs FFMPEG, nicely, returning the stdout/stderr and any error.
 func ffmpeg(args []string) (string, error) {
+	return ffmpegWithProgress(args, nil)
+}
+
+// Same as ffmpeg, but passes its output to the progress tracker, if not nil.
+func ffmpegWithProgress(args []string, progress *transcodeProgress) (string, error) {
 	nice := []string{"-n", "20", "ffmpeg"}
 	allArgs := append(nice, args...)
-	return execLog("nice", allArgs)
+	return execLogWatching("nice", allArgs, progress.onLine)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	trickplayDefaultInterval = 10  // Seconds between thumbnails.
+	trickplayThumbnailWidth  = 240 // Pixels.
+	trickplayColumns         = 10  // Thumbnails across each sprite sheet.
+	trickplayRows            = 10  // Thumbnails down each sprite sheet.
+	trickplaySpriteFilename  = "trickplay%d.jpg"
+	trickplayVTTFilename     = "thumbnails.vtt"
+	iFramesFilename          = "iframes.m3u8"
+)
+
+// What's recorded in the item's metadata, so a player can find the scrubbing previews.
+type Trickplay struct {
+	Thumbnails string // The WebVTT thumbnail track, whose cues point at sprite sheet regions.
+	IFrames    string `json:",omitempty"` // The I-frame only playlist, if there is one.
+	Interval   int    // Seconds between thumbnails.
+	Width      int    // Of each thumbnail.
+	Height     int
+}
+
+// Grabs a frame every interval into sprite sheets, and writes a WebVTT track pointing at each one, for scrubbing previews.
+// The frames come from the HLS output rather than the source, so they match what's played, crops and all.
+func generateTrickplay(outFolder string, duration float64, config Config) (*Trickplay, error) {
+	interval := trickplayInterval(config)
+	if duration <= 0 {
+		return nil, errors.New("Unknown duration")
+	}
+
+	// Make the sprite sheets.
+	args := []string{
+		"-i", filepath.Join(outFolder, hlsSegmentsFilename),
+		"-an", "-sn",
+		"-vf", trickplayFilter(interval),
+		"-q:v", "5",
+		filepath.Join(outFolder, trickplaySpriteFilename),
+	}
+	if _, err := ffmpeg(args); err != nil {
+		return nil, err
+	}
+
+	// The size of each thumbnail is simply the size of the sheet divided by the grid, as the tile filter pads partly-filled sheets.
+	firstSprite, err := os.Open(filepath.Join(outFolder, fmt.Sprintf(trickplaySpriteFilename, 1)))
+	if err != nil {
+		return nil, err
+	}
+	imageConfig, err := jpeg.DecodeConfig(firstSprite)
+	firstSprite.Close()
+	if err != nil {
+		return nil, err
+	}
+	width := imageConfig.Width / trickplayColumns
+	height := imageConfig.Height / trickplayRows
+
+	// Write the track, one cue per thumbnail. The count goes by the duration, but has to fit the sprite sheets ffmpeg actually made,
+	// as the output's length can differ a little from the source's.
+	content := "WEBVTT\n"
+	perSprite := trickplayColumns * trickplayRows
+	spriteCount := 0
+	for exists(filepath.Join(outFolder, fmt.Sprintf(trickplaySpriteFilename, spriteCount+1))) {
+		spriteCount++
+	}
+	thumbnailCount := int(math.Ceil(duration / float64(interval)))
+	if most := spriteCount * perSprite; thumbnailCount > most {
+		thumbnailCount = most
+	} else if least := (spriteCount-1)*perSprite + 1; thumbnailCount < least {
+		thumbnailCount = least
+	}
+	for i := 0; i < thumbnailCount; i++ {
+		start := float64(i * interval)
+		end := float64((i + 1) * interval)
+		if i == thumbnailCount-1 && duration > start {
+			end = math.Min(end, duration)
+		}
+		sprite := fmt.Sprintf(trickplaySpriteFilename, i/perSprite+1) // ffmpeg numbers images from 1.
+		x := (i % perSprite % trickplayColumns) * width
+		y := (i % perSprite / trickplayColumns) * height
+		content += fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", formatVTTTimestamp(start), formatVTTTimestamp(end), sprite, x, y, width, height)
+	}
+	if err := os.WriteFile(filepath.Join(outFolder, trickplayVTTFilename), []byte(content), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	trickplay := &Trickplay{
+		Thumbnails: trickplayVTTFilename,
+		Interval:   interval,
+		Width:      width,
+		Height:     height,
+	}
+	if exists(filepath.Join(outFolder, iFramesFilename)) {
+		trickplay.IFrames = iFramesFilename
+	}
+	return trickplay, nil
+}
+
+// Seconds between thumbnails, as per the config.
+func trickplayInterval(config Config) int {
+	if config.TrickplayInterval <= 0 {
+		return trickplayDefaultInterval
+	}
+	return config.TrickplayInterval
+}
+
+// Grabs a frame every interval into sprite sheets. 'iw*sar' makes non-square pixels (eg DVDs) square first, so the thumbnails aren't squashed.
+func trickplayFilter(interval int) string {
+	return fmt.Sprintf("fps=1/%d,scale=iw*sar:ih,scale=%d:-2,tile=%dx%d", interval, trickplayThumbnailWidth, trickplayColumns, trickplayRows)
+}
+
+// One keyframe, as a byte range of a segment.
+type iFrame struct {
+	URI    string
+	Time   float64 // Seconds from the start of the segment.
+	Offset int64
+	Length int64
+}
+
+// Finds the keyframes in an MPEG-TS segment, using the positions of the video packets.
+// Each keyframe's range runs until the next video packet, which covers it and any audio interleaved with it.
+func iFramesInSegment(outFolder string, segment mediaSegment) ([]iFrame, error) {
+	path := filepath.Join(outFolder, segment.URI)
+	out, err := exec.Command("ffprobe", "-v", "quiet", "-select_streams", "v:0", "-show_entries", "packet=pts_time,pos,flags", "-of", "csv=p=0", path).Output()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []iFrame
+	var segmentStart *float64
+	previousWasKey := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		pts, ptsErr := strconv.ParseFloat(fields[0], 64)
+		pos, posErr := strconv.ParseInt(fields[1], 10, 64)
+		if ptsErr != nil || posErr != nil {
+			continue
+		}
+		if segmentStart == nil {
+			segmentStart = &pts
+		}
+		if previousWasKey {
+			frames[len(frames)-1].Length = pos - frames[len(frames)-1].Offset
+		}
+		previousWasKey = strings.Contains(fields[2], "K")
+		if previousWasKey {
+			frames = append(frames, iFrame{URI: segment.URI, Time: pts - *segmentStart, Offset: pos})
+		}
+	}
+	if previousWasKey {
+		frames[len(frames)-1].Length = info.Size() - frames[len(frames)-1].Offset
+	}
+	return frames, nil
+}
+
+// Writes an I-frame only playlist for MPEG-TS segments, for players that support fast-forward/rewind with previews.
+// Returns its peak and average bandwidth, as the master playlist needs them.
+func writeIFramesPlaylist(outFolder string, segments []mediaSegment) (iFramesStream, error) {
+	var frames []iFrame
+	var segmentStarts []float64 // The time each frame's segment starts at, in the whole video.
+	elapsed := 0.0
+	for _, segment := range segments {
+		segmentFrames, err := iFramesInSegment(outFolder, segment)
+		if err != nil {
+			return iFramesStream{}, fmt.Errorf("Couldn't find the keyframes in %s - %v", segment.URI, err)
+		}
+		for range segmentFrames {
+			segmentStarts = append(segmentStarts, elapsed)
+		}
+		frames = append(frames, segmentFrames...)
+		elapsed += segment.Duration
+	}
+	if len(frames) == 0 {
+		return iFramesStream{}, errors.New("No keyframes found")
+	}
+
+	// Each I-frame's duration is until the next one. The peak bandwidth is of the I-frame with the highest bit rate over its duration.
+	durations := make([]float64, len(frames))
+	var totalBytes int64
+	stream := iFramesStream{}
+	for i, frame := range frames {
+		next := elapsed
+		if i+1 < len(frames) {
+			next = segmentStarts[i+1] + frames[i+1].Time
+		}
+		durations[i] = math.Max(0, next-(segmentStarts[i]+frame.Time))
+		totalBytes += frame.Length
+		if durations[i] > 0 {
+			stream.Bandwidth = int(math.Max(float64(stream.Bandwidth), math.Ceil(float64(frame.Length)*8/durations[i])))
+		}
+	}
+	targetDuration := 1
+	for _, d := range durations {
+		if t := int(math.Ceil(d)); t > targetDuration {
+			targetDuration = t
+		}
+	}
+
+	content := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-I-FRAMES-ONLY\n", targetDuration)
+	for i, frame := range frames {
+		content += fmt.Sprintf("#EXTINF:%f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", durations[i], frame.Length, frame.Offset, frame.URI)
+	}
+	content += "#EXT-X-ENDLIST\n"
+	if err := os.WriteFile(filepath.Join(outFolder, iFramesFilename), []byte(content), os.ModePerm); err != nil {
+		return iFramesStream{}, err
+	}
+
+	if elapsed > 0 {
+		stream.AverageBandwidth = int(float64(totalBytes) * 8 / elapsed)
+	}
+	log.Printf("Wrote an I-frame playlist with %d keyframes, peak bandwidth %d, average %d", len(frames), stream.Bandwidth, stream.AverageBandwidth)
+	return stream, nil
+}
@@ -53,7 +53,9 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		} else {
 			return errors.New("Could not parse filename, expecting something like '!MySeries - S10 Season X - E01 MyEpisode.mp4'")
 		}
-	} else { // TMDB file.
+	} else if split, err := splitMultiEpisodeFile(folder, file, paths, config); split { // Several episodes in one, eg from a DVD, which are split into one file each.
+		return err
+	} else { // TMDB file. Also a multi-episode file that isn't split, eg a double episode without chapters, which is processed as its first episode.
 		// Parse the title.
 		showTitleFromFile, seasonNumber, episodeNumber, err := showSeasonEpisodeFromFile(file)
 		if err != nil {
@@ -66,8 +68,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 			} else {
 				log.Println("Couldn't guess the episode, error:", guessErr)
 				log.Println("Failed to parse season/episode for", file)
-				failedPath := filepath.Join(paths.Failed, file) // Move to 'failed'.
-				os.Rename(inPath, failedPath)
+				moveToFailed(inPath, paths)
 				return err
 			}
 		}
@@ -78,8 +79,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		seriesId := tvdbSearchForSeries(showTitleFromFile)
 		if seriesId == "" {
 			log.Println("Could not find TV show for", showTitleFromFile)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return errors.New("Could not find TV show")
 		}
 
@@ -87,8 +87,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		series, err = tvdbSeriesDetails(seriesId)
 		if err != nil {
 			log.Println("Could not get TV show metadata for", showTitleFromFile)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return err
 		}
 
@@ -101,8 +100,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		}
 		if seasonId <= 0 {
 			log.Println("Could not find season number", seasonNumber)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return errors.New("Season number")
 		}
 
@@ -111,8 +109,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		season, err = tvdbSeasonDetails(seriesId, seasonId, seasonNumber)
 		if err != nil {
 			log.Println("Could not get season metadata for", showTitleFromFile, "; seriesId", seriesId, "seasonId", seasonId, "seasonNumber", seasonNumber)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return err
 		}
 
@@ -125,8 +122,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		}
 		if episodeId <= 0 {
 			log.Println("Could not find episode id for ", showTitleFromFile)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return errors.New("Episode number")
 		}
 
@@ -134,8 +130,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 		episode, err = tvdbEpisodeDetails(seriesId, seasonId, seasonNumber, episodeId)
 		if err != nil {
 			log.Println("Could not get episode metadata for", showTitleFromFile)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
 			return err
 		}
 	}
@@ -159,7 +154,7 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 	getTVImageIfNeeded(episode.Image, episodeFolder, imageFilename)
 
 	// Convert it.
-	convertErr := convertToHLSAppropriately(inPath, episodeFolder, config)
+	convertErr := convertToHLSWithWorkers(inPath, episodeFolder, config, paths)
 
 	// Fail! Move it to the failed folder.
 	if convertErr != nil {
@@ -168,8 +163,8 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 			log.Println("Failed to convert", file, "; file renamed for user intervention, err:", err)
 		default:
 			log.Println("Failed to convert", file, "; moving to the Failed folder, err:", err)
-			failedPath := filepath.Join(paths.Failed, file) // Move it to 'failed'.
-			os.Rename(inPath, failedPath)
+			moveToFailed(inPath, paths)
+			writeFailedReason(inPath, paths, err.Error())
 		}
 		os.RemoveAll(episodeFolder) // Tidy up.
 		return errors.New("Couldn't convert " + file)
@@ -178,7 +173,17 @@ func processTV(folder string, file string, paths Paths, config Config) error {
 	// Success!
 	// Assumption is that the user ripped their original from their DVD so doesn't care to lose it and would prefer to save the space.
 	log.Println("Success! Removing original.")
-	os.Remove(inPath)
+	removeSource(inPath)
+
+	// Fill in any images TVDB didn't have.
+	generateTVStillsIfNeeded(showFolder, seasonFolder, episodeFolder)
+
+	// Find the intro and credits.
+	if config.SkipMarkers || config.DebugSkipHLS {
+		log.Println("Not looking for the intro and credits")
+	} else {
+		findEpisodeMarkers(seasonFolder, episodeFolder)
+	}
 
 	// Generate metadata.
 	generateMetadata(paths)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Streams whose durations are within this many seconds count as the same length, so the resolution decides between them.
+const videoSelectionDurationTolerance = 1.0
+
+// Picks the video stream: the one the filename asks for with eg 'VideoStream2', otherwise the longest real video, then the biggest.
+// Cover art (attached pictures in mkv/mp4) is never picked, as it's a single image rather than video.
+// DVD angles can't be picked here, as they're interleaved in one stream rather than being streams of their own.
+func selectVideoStream(streams []ProbeStream, inPath string) (ProbeStream, error) {
+	if indexFromFilename := videoStreamFromFile(inPath); indexFromFilename != nil {
+		for _, stream := range streams {
+			if stream.Index == *indexFromFilename {
+				log.Printf("Video selection: using %s as per the filename", describeVideoStream(stream))
+				return stream, nil
+			}
+		}
+		return ProbeStream{}, errors.New("Couldn't find the video stream with the index as per the filename")
+	}
+
+	var best *ProbeStream
+	for i, stream := range streams {
+		if stream.Disposition.Attached_pic == 1 {
+			log.Printf("Video selection: skipping %s as it's an attached picture", describeVideoStream(stream))
+			continue
+		}
+		if best == nil || isBetterVideoStream(stream, *best) {
+			best = &streams[i]
+		}
+	}
+	if best == nil {
+		return ProbeStream{}, errors.New("No video stream, only attached pictures")
+	}
+	if len(streams) > 1 {
+		log.Printf("Video selection: picked %s", describeVideoStream(*best))
+	}
+	return *best, nil
+}
+
+// Whether a is longer than b, or the same length but has more pixels.
+func isBetterVideoStream(a ProbeStream, b ProbeStream) bool {
+	aDuration, bDuration := a.durationSeconds(), b.durationSeconds()
+	if aDuration > bDuration+videoSelectionDurationTolerance {
+		return true
+	}
+	if aDuration < bDuration-videoSelectionDurationTolerance {
+		return false
+	}
+	return a.Width*a.Height > b.Width*b.Height
+}
+
+// Eg 'stream 0 (h264 1920x1080, 5400s)', for logging.
+func describeVideoStream(stream ProbeStream) string {
+	return fmt.Sprintf("stream %d (%s %dx%d, %.0fs)", stream.Index, stream.Codec_name, stream.Width, stream.Height, stream.durationSeconds())
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// One cue from a WebVTT file.
+type vttCue struct {
+	Identifier string  // Optional.
+	Start      float64 // Seconds.
+	End        float64
+	Settings   string // Anything after the end time, eg 'align:start position:10%'.
+	Text       string // The payload, possibly several lines.
+}
+
+// Parses the cues out of a WebVTT file, skipping the header, notes and styles.
+func parseWebVTT(content string) []vttCue {
+	cues := make([]vttCue, 0)
+	blocks := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n\n")
+	for _, block := range blocks {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			if !strings.Contains(line, "-->") {
+				continue
+			}
+			parts := strings.Fields(line)
+			if len(parts) < 3 {
+				break
+			}
+			start, okStart := parseVTTTimestamp(parts[0])
+			end, okEnd := parseVTTTimestamp(parts[2])
+			if okStart && okEnd {
+				cue := vttCue{
+					Start:    start,
+					End:      end,
+					Settings: strings.Join(parts[3:], " "),
+					Text:     strings.Join(lines[i+1:], "\n"),
+				}
+				if i > 0 {
+					cue.Identifier = lines[i-1]
+				}
+				cues = append(cues, cue)
+			}
+			break
+		}
+	}
+	return cues
+}
+
+// Parses eg '01:02:03.456' or '02:03.456' into seconds.
+func parseVTTTimestamp(s string) (float64, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	seconds := 0.0
+	for _, part := range parts {
+		value, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		seconds = seconds*60 + value
+	}
+	return seconds, true
+}
+
+// Eg 3723.456 -> '01:02:03.456'.
+func formatVTTTimestamp(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+// Splits the cues into WebVTT segments that line up with the video's segments, and writes a playlist for them.
+// A cue that spans a segment boundary is repeated in both, which players handle.
+// If mpegtsStart is given, each segment gets an X-TIMESTAMP-MAP so players can sync it to the video.
+func writeSegmentedWebVTT(outFolder string, playlistFilename string, cues []vttCue, videoSegments []mediaSegment, mpegtsStart *int64) error {
+	header := "WEBVTT\n"
+	if mpegtsStart != nil {
+		header += fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", *mpegtsStart)
+	}
+	baseName := strings.TrimSuffix(playlistFilename, filepath.Ext(playlistFilename))
+	segments := make([]mediaSegment, 0)
+	segmentStart := 0.0
+	for i, videoSegment := range videoSegments {
+		segmentEnd := segmentStart + videoSegment.Duration
+		isLast := i == len(videoSegments)-1
+		content := header
+		for _, cue := range cues {
+			if cue.End > segmentStart && (cue.Start < segmentEnd || (isLast && cue.Start >= segmentEnd)) {
+				content += "\n"
+				if cue.Identifier != "" {
+					content += cue.Identifier + "\n"
+				}
+				content += fmt.Sprintf("%s --> %s", formatVTTTimestamp(cue.Start), formatVTTTimestamp(cue.End))
+				if cue.Settings != "" {
+					content += " " + cue.Settings
+				}
+				content += "\n" + cue.Text + "\n"
+			}
+		}
+		segment := mediaSegment{Duration: videoSegment.Duration, URI: fmt.Sprintf("%s_%d.vtt", baseName, i)}
+		if err := os.WriteFile(filepath.Join(outFolder, segment.URI), []byte(content), os.ModePerm); err != nil {
+			return err
+		}
+		segments = append(segments, segment)
+		segmentStart = segmentEnd
+	}
+	return writeMediaPlaylist(filepath.Join(outFolder, playlistFilename), segments)
+}
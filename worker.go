@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	workerPollInterval  = 10 * time.Second // How often an idle worker asks for a job.
+	workerRetryInterval = 30 * time.Second // How long to wait if the daemon can't be reached.
+)
+
+// The daemon's worker token, sent with every request.
+var workerToken string
+
+// Runs as a worker, eg 'gondola worker http://gondola.local:8077', transcoding jobs for the daemon forever.
+func runWorker(serverURL string, token string) {
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	workerToken = token
+	log.Println("Working for", serverURL)
+	for {
+		job, err := claimWorkerJob(serverURL)
+		if err != nil {
+			log.Println("Couldn't ask for a job:", err)
+			time.Sleep(workerRetryInterval)
+		} else if job == nil {
+			time.Sleep(workerPollInterval)
+		} else {
+			doWorkerJob(serverURL, *job)
+		}
+	}
+}
+
+// Asks the daemon for a job. Returns nil if there isn't one.
+func claimWorkerJob(serverURL string) (*WorkerJob, error) {
+	resp, err := workerRequest(http.MethodPost, serverURL+"/jobs/claim", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	var job WorkerJob
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	return &job, err
+}
+
+// Downloads the source, transcodes it the same way the daemon would, and uploads the HLS.
+// Heartbeats are sent throughout. If the daemon stops accepting them, it's doing the job itself, so the result is thrown away.
+func doWorkerJob(serverURL string, job WorkerJob) {
+	log.Println("Got job", job.ID, "for", job.File)
+	jobURL := serverURL + "/jobs/" + url.PathEscape(job.ID)
+	folder, err := ioutil.TempDir("", "gondola-worker")
+	if err != nil {
+		log.Println("Couldn't make a temporary folder:", err)
+		return
+	}
+	defer os.RemoveAll(folder)
+	paths := Paths{Root: folder, Staging: folder} // Progress goes into folder/status.json, for the heartbeats.
+	outFolder := filepath.Join(folder, "out")
+	os.MkdirAll(outFolder, os.ModePerm)
+
+	// Heartbeats.
+	var lost atomic.Bool
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		interval := time.Duration(valueOrDefault(job.LeaseSeconds, workerDefaultLeaseSeconds)) * time.Second / 3
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+				if err := sendWorkerHeartbeat(jobURL, paths); err != nil {
+					log.Println("Heartbeat failed:", err)
+					if errors.Is(err, errWorkerJobGone) {
+						lost.Store(true)
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	// Download.
+	for _, file := range append([]string{job.File}, job.Sidecars...) {
+		log.Println("Downloading", file)
+		if err := downloadWorkerSource(jobURL, file, filepath.Join(folder, file)); err != nil {
+			log.Println("Couldn't download", file, "-", err)
+			return // The lease will run out, and the daemon will do it instead.
+		}
+	}
+
+	// Transcode.
+	inPath := filepath.Join(folder, job.File)
+	convertErr := convertToHLSAppropriately(inPath, outFolder, job.Settings.config(), paths)
+	if lost.Load() {
+		log.Println("The daemon took job", job.ID, "back, so throwing away the result")
+		return
+	}
+	if convertErr != nil {
+		log.Println("Job", job.ID, "failed:", convertErr)
+		var renamedErr *convertRenamedError
+		completeWorkerJob(jobURL, WorkerResult{Error: convertErr.Error(), NeedsUser: errors.As(convertErr, &renamedErr)})
+		return
+	}
+
+	// Upload.
+	log.Println("Uploading the HLS for", job.File)
+	if err := uploadWorkerOutput(jobURL, outFolder); err != nil {
+		log.Println("Couldn't upload the HLS:", err)
+		return
+	}
+	completeWorkerJob(jobURL, WorkerResult{})
+	log.Println("Finished job", job.ID)
+}
+
+var errWorkerJobGone = errors.New("The daemon no longer has this job")
+
+// Tells the daemon the worker's still going, and how far it's got.
+func sendWorkerHeartbeat(jobURL string, paths Paths) error {
+	status := TranscodeStatus{}
+	if statuses := readTranscodeStatuses(paths); len(statuses) > 0 {
+		status = statuses[0]
+	}
+	data, _ := json.Marshal(status)
+	resp, err := workerRequest(http.MethodPost, jobURL+"/heartbeat", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errWorkerJobGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func downloadWorkerSource(jobURL string, file string, path string) error {
+	resp, err := workerRequest(http.MethodGet, jobURL+"/source?file="+url.QueryEscape(file), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %d", resp.StatusCode)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(out, resp.Body)
+	closeErr := out.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	return closeErr
+}
+
+// Sends the output folder as a tar, streamed so it doesn't all have to fit in memory.
+func uploadWorkerOutput(jobURL string, outFolder string) error {
+	files, err := ioutil.ReadDir(outFolder)
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		archive := tar.NewWriter(writer)
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if err := addFileToTar(archive, filepath.Join(outFolder, file.Name()), file); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(archive.Close())
+	}()
+
+	resp, err := workerRequest(http.MethodPost, jobURL+"/upload", "application/x-tar", reader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func addFileToTar(archive *tar.Writer, path string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+func completeWorkerJob(jobURL string, result WorkerResult) {
+	data, _ := json.Marshal(result)
+	resp, err := workerRequest(http.MethodPost, jobURL+"/complete", "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Println("Couldn't tell the daemon the job is complete:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Println("The daemon didn't accept the job being complete, status:", resp.StatusCode)
+	}
+}
+
+// Sends a request to the daemon, with the token.
+func workerRequest(method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+workerToken)
+	return http.DefaultClient.Do(req)
+}
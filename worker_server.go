@@ -0,0 +1,549 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	workerDefaultLeaseSeconds = 60 // How long a worker can go without a heartbeat before its job is done locally instead.
+	workerDefaultWaitSeconds  = 30 // How long a job waits for a worker to claim it before it's done locally.
+	workerReadHeaderTimeout   = 30 * time.Second
+	workerIdleTimeout         = 2 * time.Minute
+	workerMinTokenLength      = 16
+	workerTokenEnvironment    = "GONDOLA_WORKER_TOKEN" // Where a worker gets the token from, so it's not in the process list.
+)
+
+// The states of a job offered to workers.
+const (
+	workerJobWaiting   = "waiting"   // For a worker to claim it.
+	workerJobClaimed   = "claimed"   // A worker is transcoding it, and sending heartbeats.
+	workerJobUploading = "uploading" // The worker is sending the HLS back.
+	workerJobDone      = "done"      // The worker has finished, successfully or not.
+	workerJobAbandoned = "abandoned" // It's being done locally instead, so anything more from the worker is ignored.
+)
+
+// A transcode job, as sent to a worker when it claims it.
+type WorkerJob struct {
+	ID           string
+	File         string         // The source's filename. It matters, as it has flags like 'deinterlace' in it.
+	Sidecars     []string       // Subtitle files that go with the source.
+	Settings     WorkerSettings // The daemon's, so the worker transcodes the same way.
+	LeaseSeconds int            // How often the worker needs to send heartbeats.
+}
+
+// The parts of the daemon's config that transcoding uses. The rest, eg where the library is and the worker token, stays on the daemon.
+type WorkerSettings struct {
+	AudioSelection       AudioSelection
+	HLSSegmentType       string
+	HEVCPassthrough      bool
+	Encoder              EncoderSettings
+	EncoderPresets       map[string]EncoderSettings
+	LoudnessTarget       float64
+	Downmix              map[string]string
+	SkipTrickplay        bool
+	TrickplayInterval    int
+	KeepSurround         bool
+	VerifySampleDecode   bool
+	SkipEstimate         bool
+	EstimateCeilingHours float64
+}
+
+func workerSettingsFrom(config Config) WorkerSettings {
+	return WorkerSettings{
+		AudioSelection:       config.AudioSelection,
+		HLSSegmentType:       config.HLSSegmentType,
+		HEVCPassthrough:      config.HEVCPassthrough,
+		Encoder:              config.Encoder,
+		EncoderPresets:       config.EncoderPresets,
+		LoudnessTarget:       config.LoudnessTarget,
+		Downmix:              config.Downmix,
+		SkipTrickplay:        config.SkipTrickplay,
+		TrickplayInterval:    config.TrickplayInterval,
+		KeepSurround:         config.KeepSurround,
+		VerifySampleDecode:   config.VerifySampleDecode,
+		SkipEstimate:         config.SkipEstimate,
+		EstimateCeilingHours: config.EstimateCeilingHours,
+	}
+}
+
+// A config for the worker to transcode with.
+func (s WorkerSettings) config() Config {
+	return Config{
+		AudioSelection:       s.AudioSelection,
+		HLSSegmentType:       s.HLSSegmentType,
+		HEVCPassthrough:      s.HEVCPassthrough,
+		Encoder:              s.Encoder,
+		EncoderPresets:       s.EncoderPresets,
+		LoudnessTarget:       s.LoudnessTarget,
+		Downmix:              s.Downmix,
+		SkipTrickplay:        s.SkipTrickplay,
+		TrickplayInterval:    s.TrickplayInterval,
+		KeepSurround:         s.KeepSurround,
+		VerifySampleDecode:   s.VerifySampleDecode,
+		SkipEstimate:         s.SkipEstimate,
+		EstimateCeilingHours: s.EstimateCeilingHours,
+	}
+}
+
+// What a worker sends when it's done.
+type WorkerResult struct {
+	Error     string // "" means it worked, and the HLS has been uploaded.
+	NeedsUser bool   // The source needs the user to choose something, eg the audio stream, which is done locally.
+}
+
+// A job, as the daemon keeps track of it.
+type workerJob struct {
+	WorkerJob
+	inPath    string
+	outFolder string
+	state     string
+	offered   time.Time
+	heartbeat time.Time
+	result    WorkerResult
+	progress  *transcodeProgress
+	upload    *workerUpload // What the worker's upload put into outFolder, in case it needs undoing.
+}
+
+// Hands transcode jobs to 'gondola worker' processes, eg on a fast desktop, over HTTP.
+type workerServer struct {
+	mutex  sync.Mutex
+	jobs   map[string]*workerJob // Keyed by ID. Protected by the mutex.
+	nextID int
+	config Config
+	paths  Paths
+}
+
+var workers *workerServer // Nil unless the config has a workerListen address.
+
+// Starts listening for workers, if the config asks for it.
+func startWorkerServer(config Config, paths Paths) {
+	if config.WorkerListen == "" {
+		return
+	}
+	workers = &workerServer{jobs: make(map[string]*workerJob), config: config, paths: paths}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs/", workers.handle)
+	address := workerListenAddress(config.WorkerListen)
+	// There's no overall read timeout, as uploads can take a while. Instead, uploads have a deadline that's extended as data arrives.
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: workerReadHeaderTimeout,
+		IdleTimeout:       workerIdleTimeout,
+	}
+	go func() {
+		log.Println("Listening for workers on", address)
+		if err := server.ListenAndServe(); err != nil {
+			log.Println("Couldn't listen for workers:", err)
+		}
+	}()
+}
+
+// Just a port, eg ':8077', means loopback only, so workers on other machines need the address to be given, eg '0.0.0.0:8077'.
+func workerListenAddress(listen string) string {
+	if host, port, err := net.SplitHostPort(listen); err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return listen
+}
+
+// Converts to HLS, using a worker if one claims the job in time, otherwise locally.
+func convertToHLSWithWorkers(inPath string, outFolder string, config Config, paths Paths) error {
+	if workers != nil && !config.DebugSkipHLS {
+		if handled, err := workers.convert(inPath, outFolder); handled {
+			return err
+		}
+	}
+	return convertToHLSAppropriately(inPath, outFolder, config, paths)
+}
+
+// Offers the job to workers, and waits for one to do it. Returns false if none did, so it needs doing locally:
+// because no worker claimed it in time, its worker vanished, it needs the user to choose something, or what it uploaded failed verification.
+func (s *workerServer) convert(inPath string, outFolder string) (bool, error) {
+	lease := time.Duration(valueOrDefault(s.config.WorkerLeaseSeconds, workerDefaultLeaseSeconds)) * time.Second
+	wait := time.Duration(valueOrDefault(s.config.WorkerWaitSeconds, workerDefaultWaitSeconds)) * time.Second
+
+	s.mutex.Lock()
+	s.nextID++
+	job := &workerJob{
+		WorkerJob: WorkerJob{
+			ID:           fmt.Sprintf("%d-%d", time.Now().Unix(), s.nextID),
+			File:         filepath.Base(inPath),
+			Settings:     workerSettingsFrom(s.config),
+			LeaseSeconds: int(lease.Seconds()),
+		},
+		inPath:    inPath,
+		outFolder: outFolder,
+		state:     workerJobWaiting,
+		offered:   time.Now(),
+	}
+	for _, sidecar := range sidecarSubtitlesFor(inPath) {
+		job.Sidecars = append(job.Sidecars, filepath.Base(sidecar.Path))
+	}
+	s.jobs[job.ID] = job
+	s.mutex.Unlock()
+	log.Println("Offering", job.File, "to workers, as job", job.ID)
+
+	// Once it's finished with, late requests from its worker get told it's gone.
+	defer func() {
+		s.mutex.Lock()
+		delete(s.jobs, job.ID)
+		progress := job.progress
+		s.mutex.Unlock()
+		progress.finish()
+	}()
+
+	for {
+		time.Sleep(time.Second)
+		s.mutex.Lock()
+		reason := ""
+		switch job.state {
+		case workerJobWaiting:
+			if time.Since(job.offered) > wait {
+				reason = "no worker claimed it"
+			}
+		case workerJobClaimed:
+			if time.Since(job.heartbeat) > lease {
+				reason = "its worker stopped sending heartbeats"
+			}
+		case workerJobUploading:
+			if time.Since(job.heartbeat) > lease {
+				reason = "its worker's upload stalled"
+			}
+		case workerJobDone:
+			if job.result.NeedsUser {
+				reason = "the worker says it needs the user to choose something"
+			}
+		}
+		if reason != "" {
+			job.state = workerJobAbandoned // So an upload that's still going isn't put into place.
+		}
+		state, result, upload := job.state, job.result, job.upload
+		s.mutex.Unlock()
+
+		if reason != "" {
+			log.Println("Doing", job.File, "locally, as", reason)
+			upload.rollBack()
+			return false, nil
+		}
+		if state != workerJobDone {
+			continue
+		}
+		if result.Error != "" {
+			upload.rollBack()
+			return true, errors.New("The worker failed: " + result.Error)
+		}
+
+		// Check what was uploaded as thoroughly as if it were done locally, as the source gets deleted next.
+		sourceProbe, err := probe(inPath)
+		if err != nil {
+			log.Println("Couldn't probe", job.File, "to verify the worker's HLS, so doing it locally:", err)
+			upload.rollBack()
+			return false, nil
+		}
+		if err := verifyHLS(outFolder, sourceProbe.Format.durationSeconds(), sourceProbe.Format.durationIsEstimated(), s.config.VerifySampleDecode); err != nil {
+			log.Println("The HLS from the worker for", job.File, "failed verification, so doing it locally:", err)
+			upload.rollBack()
+			return false, nil
+		}
+		log.Println("The worker finished", job.File)
+		return true, nil
+	}
+}
+
+// Routes eg '/jobs/claim' and '/jobs/123-1/heartbeat'. Every request needs the token.
+func (s *workerServer) handle(w http.ResponseWriter, r *http.Request) {
+	if !isWorkerTokenValid(r, s.config.WorkerToken) {
+		log.Println("Rejected a worker request without the right token from", r.RemoteAddr)
+		http.Error(w, "Wrong or missing worker token", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	if len(parts) == 1 && parts[0] == "claim" && r.Method == http.MethodPost {
+		s.handleClaim(w, r)
+		return
+	}
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mutex.Lock()
+	job := s.jobs[parts[0]]
+	s.mutex.Unlock()
+	if job == nil {
+		http.Error(w, "No such job, it may have been done locally instead", http.StatusGone)
+		return
+	}
+	switch parts[1] {
+	case "source":
+		s.handleSource(w, r, job)
+	case "heartbeat":
+		s.handleHeartbeat(w, r, job)
+	case "upload":
+		s.handleUpload(w, r, job)
+	case "complete":
+		s.handleComplete(w, r, job)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Whether the request has the token, as 'Authorization: Bearer <token>'. Compared in constant time, so it can't be guessed a character at a time.
+func isWorkerTokenValid(r *http.Request, token string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// Gives the worker the oldest waiting job, or 204 if there isn't one.
+func (s *workerServer) handleClaim(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	var job *workerJob
+	for _, candidate := range s.jobs {
+		if candidate.state == workerJobWaiting && (job == nil || candidate.offered.Before(job.offered)) {
+			job = candidate
+		}
+	}
+	if job != nil {
+		job.state = workerJobClaimed
+		job.heartbeat = time.Now()
+		job.progress = startTranscodeProgress(s.paths, job.File+" (on "+r.RemoteAddr+")", 0)
+	}
+	s.mutex.Unlock()
+
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Println("Worker", r.RemoteAddr, "claimed", job.File)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job.WorkerJob)
+}
+
+// Sends the source, or one of its sidecar subtitles, eg '/jobs/123-1/source?file=Movie.vob'.
+func (s *workerServer) handleSource(w http.ResponseWriter, r *http.Request, job *workerJob) {
+	file := r.URL.Query().Get("file")
+	if file == job.File {
+		http.ServeFile(w, r, job.inPath)
+		return
+	}
+	for _, sidecar := range job.Sidecars {
+		if file == sidecar {
+			http.ServeFile(w, r, filepath.Join(filepath.Dir(job.inPath), sidecar))
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// Keeps the lease going. The body is the worker's progress, which goes into the status file.
+func (s *workerServer) handleHeartbeat(w http.ResponseWriter, r *http.Request, job *workerJob) {
+	var status TranscodeStatus
+	json.NewDecoder(r.Body).Decode(&status) // It's fine if there's no progress yet.
+
+	s.mutex.Lock()
+	claimed := job.state == workerJobClaimed
+	if claimed {
+		job.heartbeat = time.Now()
+	}
+	progress := job.progress
+	s.mutex.Unlock()
+	if !claimed {
+		http.Error(w, "Job isn't claimed", http.StatusGone)
+		return
+	}
+	progress.update(status)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Receives the HLS as a tar, into a temporary folder first so a broken upload doesn't leave half an item.
+// Each time data arrives, the lease and the read deadline are extended, so a stalled upload times out but a slow one doesn't.
+// It's only put into place if the job is still wanted, ie it hasn't been taken back to do locally meanwhile.
+func (s *workerServer) handleUpload(w http.ResponseWriter, r *http.Request, job *workerJob) {
+	lease := time.Duration(job.LeaseSeconds) * time.Second
+	s.mutex.Lock()
+	claimed := job.state == workerJobClaimed
+	if claimed {
+		job.state = workerJobUploading // Uploads can take a while, and there are no heartbeats meanwhile.
+		job.heartbeat = time.Now()
+	}
+	s.mutex.Unlock()
+	if !claimed {
+		http.Error(w, "Job isn't claimed", http.StatusGone)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	body := &leaseExtendingReader{reader: r.Body, extend: func() {
+		controller.SetReadDeadline(time.Now().Add(lease))
+		s.mutex.Lock()
+		job.heartbeat = time.Now()
+		s.mutex.Unlock()
+	}}
+	tempFolder, err := ioutil.TempDir(s.paths.Staging, "upload")
+	if err == nil {
+		defer os.RemoveAll(tempFolder)
+		err = receiveUpload(body, tempFolder)
+	}
+	controller.SetReadDeadline(time.Time{})
+
+	s.mutex.Lock()
+	wanted := job.state == workerJobUploading
+	if wanted && err == nil {
+		job.upload, err = installUpload(tempFolder, job.outFolder) // While locked, so it can't be taken back halfway through.
+	}
+	if wanted {
+		job.state = workerJobClaimed
+		job.heartbeat = time.Now()
+	}
+	s.mutex.Unlock()
+	if !wanted {
+		http.Error(w, "Job was taken back to be done locally", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Println("Upload of", job.File, "failed:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Println("Received the HLS for", job.File)
+	w.WriteHeader(http.StatusOK)
+}
+
+// Calls extend before every read.
+type leaseExtendingReader struct {
+	reader io.Reader
+	extend func()
+}
+
+func (l *leaseExtendingReader) Read(p []byte) (int, error) {
+	l.extend()
+	return l.reader.Read(p)
+}
+
+// Unpacks the tar into the temporary folder.
+func receiveUpload(body io.Reader, tempFolder string) error {
+	archive := tar.NewReader(body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(header.Name) || strings.ContainsAny(header.Name, `/\`) {
+			return errors.New("Unexpected file in upload: " + header.Name)
+		}
+		file, err := os.Create(filepath.Join(tempFolder, header.Name))
+		if err != nil {
+			return err
+		}
+		_, copyErr := io.Copy(file, archive)
+		closeErr := file.Close()
+		if copyErr != nil {
+			return copyErr
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+}
+
+// What an upload put into an item's folder, so it can be undone, eg if it fails verification.
+type workerUpload struct {
+	outFolder string
+	files     []string // Moved in from the upload.
+	metadata  []byte   // metadata.json as it was before, or nil if there wasn't one.
+}
+
+// Moves the upload into place. The worker's metadata.json only has what transcoding added (eg the encoder), so that's merged rather than replacing the daemon's.
+// If anything goes wrong, what's been done so far is undone, so there's never half an item.
+func installUpload(tempFolder string, outFolder string) (*workerUpload, error) {
+	files, err := ioutil.ReadDir(tempFolder)
+	if err != nil {
+		return nil, err
+	}
+	upload := &workerUpload{outFolder: outFolder}
+	upload.metadata, _ = ioutil.ReadFile(filepath.Join(outFolder, metadataFilename))
+	var metadata map[string]json.RawMessage
+	for _, file := range files {
+		if file.Name() == metadataFilename {
+			if err := readAndUnmarshal(tempFolder, metadataFilename, &metadata); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := os.Rename(filepath.Join(tempFolder, file.Name()), filepath.Join(outFolder, file.Name())); err != nil {
+			upload.rollBack()
+			return nil, err
+		}
+		upload.files = append(upload.files, file.Name())
+	}
+	for key, value := range metadata {
+		if err := mergeIntoItemMetadata(outFolder, key, value); err != nil {
+			upload.rollBack()
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// Removes what the upload moved in, and puts the metadata back as it was. Does nothing if nil.
+func (u *workerUpload) rollBack() {
+	if u == nil {
+		return
+	}
+	for _, file := range u.files {
+		os.Remove(filepath.Join(u.outFolder, file))
+	}
+	metadataPath := filepath.Join(u.outFolder, metadataFilename)
+	if u.metadata != nil {
+		ioutil.WriteFile(metadataPath, u.metadata, os.ModePerm)
+	} else {
+		os.Remove(metadataPath)
+	}
+}
+
+// The worker's done, or has failed.
+func (s *workerServer) handleComplete(w http.ResponseWriter, r *http.Request, job *workerJob) {
+	var result WorkerResult
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mutex.Lock()
+	claimed := job.state == workerJobClaimed
+	if claimed {
+		job.state = workerJobDone
+		job.result = result
+	}
+	s.mutex.Unlock()
+	if !claimed {
+		http.Error(w, "Job isn't claimed", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Eg for config values where 0 means the default.
+func valueOrDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}